@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,26 +19,40 @@ var Version = "unset"
 var (
 	app     = kingpin.New("deployman", "A CLI for controlling ALB and two AutoScalingGroups and performing Blue/Green Deployment.")
 	config  = app.Flag("config", "[OPTIONAL] Configuration file path. By default, this value is './deployman.json'. If this file does not exist, an error will occur.").Default("./deployman.json").String()
-	verbose = app.Flag("verbose", "[OPTIONAL] A detailed log containing call stacks will be error messages.").Bool()
+	env     = app.Flag("env", "[OPTIONAL] Name of the environment in 'environments' of the configuration file, such as 'prod'. Required if the file has environments.").Envar("DEPLOYMAN_ENV").String()
+	verbose = app.Flag("verbose", "[OPTIONAL] A detailed log containing call stacks will be error messages. The number of calls per AWS API is shown at the end.").Bool()
 
 	version = app.Command("version", "Show current CLI version.")
 
+	initCommand         = app.Command("init", "Generate the configuration file from the target groups of the listener rule and the AutoScalingGroups attached to them. The file is written to '--config'.")
+	initListenerRuleArn = initCommand.Flag("listener-rule-arn", "[REQUIRED] Rule ARN of the ALB listener to deploy to. The forward action must have 2 target groups, the first for blue and the second for green.").Required().String()
+	initBundleBucket    = initCommand.Flag("bundle-bucket", "[OPTIONAL] S3 bucket name for application bundles. By default, '<load balancer name>-deployman-<account>' is suggested.").String()
+	initSsm             = initCommand.Flag("ssm", "[OPTIONAL] Name of the SSM parameter to store the configuration in, instead of the file.").String()
+	initForce           = initCommand.Flag("force", "[OPTIONAL] Overwrite the existing configuration file or SSM parameter.").Bool()
+
 	bundle = app.Command("bundle", "")
 
 	bundleRegister         = bundle.Command("register", "Register a new application bundle with any name, specifying the local file path to S3 bucket.")
 	bundleRegisterFilepath = bundleRegister.Flag("file", "[REQUIRED] File name and path in local").Required().String()
 	bundleRegisterName     = bundleRegister.Flag("name", "[REQUIRED] Name of bundle to be registered").Required().String()
 	bundleRegisterActivate = bundleRegister.Flag("with-activate", "[OPTIONAL] Associate (activate) this bundle with an idle AutoScalingGroup.").Bool()
+	bundleRegisterMeta     = bundleRegister.Flag("meta", "[OPTIONAL] Label of the bundle as 'key=value', such as '--meta release=v1.2.0'. Repeatable. The git commit, branch, author and the build URL of CI are added automatically.").PlaceHolder("KEY=VALUE").StringMap()
+	bundleRegisterSignKey  = bundleRegister.Flag("sign-key", "[OPTIONAL] Path of the ed25519 private key (PKCS#8 PEM) to sign the bundle with. The signature is stored next to the bundle.").String()
 
-	bundleList       = bundle.Command("list", "List registered application bundles.")
-	bundleListOutput = bundleList.Flag("output", "Output format (table, json). Default is table.").Default("table").Enum("table", "json")
+	bundleList        = bundle.Command("list", "List registered application bundles.")
+	bundleListOutput  = bundleList.Flag("output", "Output format (table, json). Default is table.").Default("table").Enum("table", "json")
+	bundleListColumns = bundleList.Flag("columns", "[OPTIONAL] Labels to show as the columns of the table, separated by commas. Default is 'git-commit,git-branch'.").Default(strings.Join(internal.DefaultBundleColumns, ",")).String()
+	bundleListFilter  = bundleList.Flag("filter", "[OPTIONAL] Show only the bundles with the label, such as '--filter git-branch=main'. Repeatable, and all of them must match.").PlaceHolder("KEY=VALUE").StringMap()
 
 	bundleActivate       = bundle.Command("activate", "Activate one of the registered bundles. The active bundle will be used for the next deployment or scale-out.")
 	bundleActivateTarget = bundleActivate.Flag("target", "[REQUIRED] Target type for bundle. Valid values are either 'blue' or 'green'. The 'ec2 status' command allows you to check the target details.").Required().Enum("blue", "green")
 	bundleActivateName   = bundleActivate.Flag("name", "[REQUIRED] Bundle Name. Valid names can be checked with the 'bundle list' command.").Required().String()
 
-	bundleDownload       = bundle.Command("download", "Download application bundle file.")
-	bundleDownloadTarget = bundleDownload.Flag("target", "[REQUIRED] Target type for bundle. Valid values are either 'blue' or 'green'. The 'ec2 status' command allows you to check the target details.").Required().Enum("blue", "green")
+	bundleDownload        = bundle.Command("download", "Download application bundle file.")
+	bundleDownloadTarget  = bundleDownload.Flag("target", "[OPTIONAL] Download the bundle active in the target. Valid values are either 'blue' or 'green'. Either --target or --name is required.").Enum("blue", "green")
+	bundleDownloadName    = bundleDownload.Flag("name", "[OPTIONAL] Download the registered bundle of the name. Valid names can be checked with the 'bundle list' command.").String()
+	bundleDownloadOutput  = bundleDownload.Flag("output", "[OPTIONAL] File or directory path to write the bundle to, or '-' for stdout. Default is the bundle name in the current directory.").String()
+	bundleDownloadExtract = bundleDownload.Flag("extract", "[OPTIONAL] Directory to unzip the bundle into, instead of writing the bundle itself.").String()
 
 	ec2 = app.Command("ec2", "")
 
@@ -47,31 +62,61 @@ var (
 	ec2deploy          = ec2.Command("deploy", "Deploy a new application to an idling AutoScalingGroup.")
 	ec2deploySilent    = ec2deploy.Flag("silent", "[OPTIONAL] Skip confirmation before process.").Bool()
 	ec2deployNoCleanup = ec2deploy.Flag("no-cleanup", "[OPTIONAL] Skip cleanup of idle old AutoScalingGroups that are no longer needed after deployment.").Bool()
+	ec2deploySteps     = ec2deploy.Flag("steps", "[OPTIONAL] Percentages of traffic to shift to the new target step by step, such as '10,25,50,100'. Each step waits for '--duration' (or 'weight:duration' such as '10:30s') and checks the health of the new target before the next step. The last step must be 100.").String()
 	ec2deploySwapTime  = ec2deploy.Flag("duration", "[OPTIONAL] Time to wait until traffic is completely swapped. Default is '0s'. If this value is set to '60s', the B/G traffic is distributed 50:50 and waits for 60 seconds. After that, the B/G traffic will be completely swapped.").Default("0s").Duration()
+	ec2deployDryRun    = ec2deploy.Flag("dry-run", "[OPTIONAL] Print the ordered list of changes without making them. No confirmation or lock is required.").Bool()
+	ec2deployResume    = ec2deploy.Flag("resume", "[OPTIONAL] Continue the unfinished deployment from the last completed phase. The other options of the unfinished deployment are used.").Bool()
 
 	ec2rollback          = ec2.Command("rollback", "Restore the AutoScalingGroup to their original state, then swap traffic.")
 	ec2rollbackSilent    = ec2rollback.Flag("silent", "[OPTIONAL] Skip confirmation before process.").Bool()
 	ec2rollbackNoCleanup = ec2rollback.Flag("no-cleanup", "[OPTIONAL] Skip cleanup of idle old AutoScalingGroups that are no longer needed after deployment.").Bool()
+	ec2rollbackSteps     = ec2rollback.Flag("steps", "[OPTIONAL] Percentages of traffic to shift to the new target step by step, such as '10,25,50,100'. Each step waits for '--duration' (or 'weight:duration' such as '10:30s') and checks the health of the new target before the next step. The last step must be 100.").String()
 	ec2rollbackSwapTime  = ec2rollback.Flag("duration", "[OPTIONAL] Time to wait until traffic is completely swapped. Default is '0s'. If this value is set to '60s', the B/G traffic is distributed 50:50 and waits for 60 seconds. After that, the B/G traffic will be completely swapped.").Default("0s").Duration()
+	ec2rollbackDryRun    = ec2rollback.Flag("dry-run", "[OPTIONAL] Print the ordered list of changes without making them. No confirmation or lock is required.").Bool()
 
-	ec2cleanup = ec2.Command("cleanup", "Terminate all instances that are idle, i.e., in an AutoScalingGroup with a traffic weight of 0. You can check the current status with the 'ec2 status' command.")
+	ec2cleanup       = ec2.Command("cleanup", "Terminate all instances that are idle, i.e., in an AutoScalingGroup with a traffic weight of 0. You can check the current status with the 'ec2 status' command.")
+	ec2cleanupDryRun = ec2cleanup.Flag("dry-run", "[OPTIONAL] Print the ordered list of changes without making them. No confirmation or lock is required.").Bool()
 
 	ec2swap         = ec2.Command("swap", "B/G Swap the current traffic of the respective 2 AutoScalingGroups. You can check the current status with the 'ec2 status' command.")
+	ec2swapSteps    = ec2swap.Flag("steps", "[OPTIONAL] Percentages of traffic to shift to the new target step by step, such as '10,25,50,100'. Each step waits for '--duration' (or 'weight:duration' such as '10:30s') and checks the health of the new target before the next step. The last step must be 100.").String()
 	ec2swapDuration = ec2swap.Flag("duration", "[OPTIONAL] Time to wait until traffic is completely swapped. Default is '0s'. If this value is set to '60s', the B/G traffic is distributed 50:50 and waits for 60 seconds. After that, the B/G traffic will be completely swapped.").Default("0s").Duration()
+	ec2swapDryRun   = ec2swap.Flag("dry-run", "[OPTIONAL] Print the ordered list of changes without making them. No confirmation or lock is required.").Bool()
 
 	ec2traffic            = ec2.Command("traffic", "Update the traffic of the respective target group of B/G to any value. You can check the current status with the 'ec2 status' command.")
 	ec2trafficBlueWeight  = ec2traffic.Flag("blue", "[REQUIRED] Traffic weight for blue TargetGroup").Required().Int32()
 	ec2trafficGreenWeight = ec2traffic.Flag("green", "[REQUIRED] Traffic weight for green TargetGroup").Required().Int32()
+	ec2trafficDryRun      = ec2traffic.Flag("dry-run", "[OPTIONAL] Print the ordered list of changes without making them. No confirmation or lock is required.").Bool()
 
 	ec2autoscaling        = ec2.Command("autoscaling", "Update the capacity of any AutoScalingGroup.")
 	ec2autoscalingTarget  = ec2autoscaling.Flag("target", "[REQUIRED] Target type of AutoScalingGroup. Valid values are either 'blue' or 'green'. The 'ec2 status' command allows you to check the target details.").Required().Enum("blue", "green")
 	ec2autoscalingDesired = ec2autoscaling.Flag("desired", "[OPTIONAL] DesiredCapacity").Default("-1").Int32()
 	ec2autoscalingMinSize = ec2autoscaling.Flag("min", "[OPTIONAL] MinSize").Default("-1").Int32()
 	ec2autoscalingMaxSize = ec2autoscaling.Flag("max", "[OPTIONAL] MaxSize").Default("-1").Int32()
+	ec2autoscalingDryRun  = ec2autoscaling.Flag("dry-run", "[OPTIONAL] Print the ordered list of changes without making them. No confirmation or lock is required.").Bool()
+
+	ec2abort       = ec2.Command("abort", "Restore the capacities and traffic weights recorded at the start of the unfinished deployment.")
+	ec2abortSilent = ec2abort.Flag("silent", "[OPTIONAL] Skip confirmation before process.").Bool()
+
+	ec2history       = ec2.Command("history", "Show the history of deployments, rollbacks, swaps, traffic and capacity changes.")
+	ec2historyOutput = ec2history.Flag("output", "Output format (table, json). Default is table.").Default("table").Enum("table", "json")
+	ec2historyLimit  = ec2history.Flag("limit", "[OPTIONAL] Maximum number of records to show, from the latest. Default is 20.").Default("20").Int()
+
+	ec2moveScheduledActions       = ec2.Command("move-scheduled-actions", "Move ScheduledActions that exist in any AutoScalingGroup to another AutoScalingGroup.")
+	ec2moveScheduledActionsFrom   = ec2moveScheduledActions.Flag("from", "[REQUIRED] Name of AutoScalingGroup").Required().String()
+	ec2moveScheduledActionsTo     = ec2moveScheduledActions.Flag("to", "[REQUIRED] Name of AutoScalingGroup").Required().String()
+	ec2moveScheduledActionsDryRun = ec2moveScheduledActions.Flag("dry-run", "[OPTIONAL] Print the ordered list of changes without making them. No confirmation or lock is required.").Bool()
+
+	configCommand        = app.Command("config", "")
+	configValidate       = configCommand.Command("validate", "Check that the bundle bucket, listener rule, target groups and AutoScalingGroups in the configuration file exist and fit together.")
+	configValidateOutput = configValidate.Flag("output", "Output format (table, json). Default is table.").Default("table").Enum("table", "json")
 
-	ec2moveScheduledActions     = ec2.Command("move-scheduled-actions", "Move ScheduledActions that exist in any AutoScalingGroup to another AutoScalingGroup.")
-	ec2moveScheduledActionsFrom = ec2moveScheduledActions.Flag("from", "[REQUIRED] Name of AutoScalingGroup").Required().String()
-	ec2moveScheduledActionsTo   = ec2moveScheduledActions.Flag("to", "[REQUIRED] Name of AutoScalingGroup").Required().String()
+	lock = app.Command("lock", "")
+
+	lockStatus       = lock.Command("status", "Show the lock that prevents concurrent deployments. The lock is stored in the bundle bucket.")
+	lockStatusOutput = lockStatus.Flag("output", "Output format (table, json). Default is table.").Default("table").Enum("table", "json")
+
+	lockRelease      = lock.Command("release", "Release the lock left by an interrupted deployment.")
+	lockReleaseForce = lockRelease.Flag("force", "[OPTIONAL] Release the lock even if it is held by another owner or host.").Bool()
 )
 
 func main() {
@@ -89,6 +134,10 @@ func main() {
 		trap := make(chan os.Signal, 1)
 		signal.Notify(trap, syscall.SIGTERM, syscall.SIGINT)
 		<-trap
+		// Let the running command stop at a safe point and compensate its changes.
+		logger.Warn("🚨 Cancelling the command. Send the signal again to exit immediately.", nil)
+		cancel()
+		<-trap
 		logger.Fatal("🚨 Command Cancelled", nil)
 	}()
 
@@ -97,85 +146,178 @@ func main() {
 		os.Exit(0)
 	}
 
-	awsClient, err := internal.NewDefaultAwsClient(ctx)
+	// The config may be stored in SSM, so it is read with the ambient credentials.
+	bootstrapClient, err := internal.NewDefaultAwsClient(ctx, nil, nil)
+	if err != nil {
+		logger.Fatal("🚨 Command Failure", err)
+	}
+
+	if command == initCommand.FullCommand() {
+		// There is no config yet, so the resources are discovered with the ambient credentials.
+		initializer := internal.NewInitializer(bootstrapClient, logger)
+		var raw []byte
+		if raw, err = initializer.Discover(ctx, *initListenerRuleArn, *initBundleBucket); err == nil {
+			fmt.Print(string(raw))
+			destination := *config
+			if *initSsm != "" {
+				destination = "ssm:" + *initSsm
+			}
+			err = initializer.Write(ctx, raw, destination, *initForce)
+		}
+		if err != nil {
+			logger.Error("🚨 Command Failure", err)
+			os.Exit(1)
+		}
+		logger.Info("🎉 Command Succeeded")
+		os.Exit(0)
+	}
+
+	deployConfig, err := internal.NewConfig(ctx, bootstrapClient, *config, *env)
 	if err != nil {
 		logger.Fatal("🚨 Command Failure", err)
 	}
 
-	deployConfig, err := internal.NewConfig(ctx, awsClient, *config)
+	// The calls to read the config are counted together with the command.
+	awsClient, err := internal.NewDefaultAwsClient(ctx, deployConfig, bootstrapClient.CallStats())
 	if err != nil {
 		logger.Fatal("🚨 Command Failure", err)
 	}
 
 	deployer := internal.NewDeployer(deployConfig, awsClient, logger)
 	bundler := internal.NewBundler(deployConfig, awsClient, logger)
+	locker := internal.NewLocker(deployConfig, awsClient, logger)
+	history := internal.NewHistory(deployConfig, awsClient, logger)
+	checker := internal.NewConfigChecker(deployConfig, awsClient, logger)
 
 	switch command {
 	case bundleRegister.FullCommand():
-		if err = bundler.Register(ctx, *bundleRegisterFilepath, *bundleRegisterName); err != nil {
+		if err = bundler.Register(ctx, *bundleRegisterFilepath, *bundleRegisterName, *bundleRegisterSignKey, *bundleRegisterMeta); err != nil {
 			break
 		}
 		if *bundleRegisterActivate {
-			info, err := deployer.GetDeployInfo(ctx)
-			if err != nil {
+			var info *internal.DeployInfo
+			if info, err = deployer.GetDeployInfo(ctx); err != nil {
 				break
 			}
 			err = bundler.Activate(ctx, info.IdlingTarget.Type, *bundleRegisterName)
 		}
 
 	case bundleList.FullCommand():
-		err = bundler.ListBundles(ctx, *bundleListOutput)
+		err = bundler.ListBundles(ctx, *bundleListOutput, strings.Split(*bundleListColumns, ","), *bundleListFilter)
 
 	case bundleActivate.FullCommand():
 		err = bundler.Activate(ctx, internal.TargetType(*bundleActivateTarget), *bundleActivateName)
 
 	case bundleDownload.FullCommand():
-		err = bundler.Download(ctx, internal.TargetType(*bundleDownloadTarget))
+		err = bundler.Download(ctx, internal.TargetType(*bundleDownloadTarget), *bundleDownloadName, *bundleDownloadOutput, *bundleDownloadExtract)
 
 	case ec2status.FullCommand():
 		err = deployer.ShowStatus(ctx, *ec2statusOutput)
 
 	case ec2deploy.FullCommand():
+		var steps internal.TrafficSteps
+		if steps, err = internal.NewTrafficSteps(*ec2deploySteps, *ec2deploySwapTime); err != nil {
+			break
+		}
+		if *ec2deployResume {
+			if *ec2deployDryRun {
+				err = errors.New("'--dry-run' cannot be used with '--resume'.")
+				break
+			}
+			if err = deployer.ShowStatus(ctx, "table"); err != nil {
+				break
+			}
+			if *ec2deploySilent == false && internal.AskToContinue() == false {
+				logger.Fatal("🚨 Command Cancelled", nil)
+			}
+			err = deployer.ResumeDeploy(ctx)
+			break
+		}
+		if *ec2deployDryRun {
+			var plan *internal.Plan
+			if plan, err = deployer.PlanDeploy(ctx, true, true, !*ec2deployNoCleanup, steps); err == nil {
+				err = plan.Show("table")
+			}
+			break
+		}
 		if err = deployer.ShowStatus(ctx, "table"); err != nil {
 			break
 		}
 		if *ec2deploySilent == false && internal.AskToContinue() == false {
 			logger.Fatal("🚨 Command Cancelled", nil)
 		}
-		err = deployer.Deploy(ctx, true, true, !*ec2deployNoCleanup, ec2deploySwapTime)
-		if errors.Is(err, internal.CancellationError) {
-			logger.Fatal("🚨 Command Cancelled", err)
-		}
+		err = deployer.Deploy(ctx, true, true, !*ec2deployNoCleanup, steps)
 
 	case ec2rollback.FullCommand():
+		var steps internal.TrafficSteps
+		if steps, err = internal.NewTrafficSteps(*ec2rollbackSteps, *ec2rollbackSwapTime); err != nil {
+			break
+		}
+		if *ec2rollbackDryRun {
+			var plan *internal.Plan
+			if plan, err = deployer.PlanDeploy(ctx, true, false, !*ec2rollbackNoCleanup, steps); err == nil {
+				err = plan.Show("table")
+			}
+			break
+		}
 		if err = deployer.ShowStatus(ctx, "table"); err != nil {
 			break
 		}
 		if *ec2rollbackSilent == false && internal.AskToContinue() == false {
 			logger.Fatal("🚨 Command Cancelled", nil)
 		}
-		err = deployer.Deploy(ctx, true, false, !*ec2rollbackNoCleanup, ec2rollbackSwapTime)
-		if errors.Is(err, internal.CancellationError) {
-			logger.Fatal("🚨 Command Cancelled", err)
-		}
+		err = deployer.Deploy(ctx, true, false, !*ec2rollbackNoCleanup, steps)
 
 	case ec2cleanup.FullCommand():
-		info, err := deployer.GetDeployInfo(ctx)
-		if err != nil {
-			logger.Fatal("🚨 Command Failure", err)
+		var info *internal.DeployInfo
+		if info, err = deployer.GetDeployInfo(ctx); err != nil {
+			break
 		}
-		err = deployer.CleanupAutoScalingGroup(ctx, *info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName)
-		if errors.Is(err, internal.CancellationError) {
-			logger.Fatal("🚨 Command Cancelled", err)
+		if *ec2cleanupDryRun {
+			var plan *internal.Plan
+			if plan, err = deployer.PlanCleanupAutoScalingGroup(ctx, *info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName); err == nil {
+				err = plan.Show("table")
+			}
+			break
 		}
+		err = deployer.CleanupAutoScalingGroup(ctx, *info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName)
 
 	case ec2swap.FullCommand():
-		err = deployer.SwapTraffic(ctx, ec2swapDuration)
+		var steps internal.TrafficSteps
+		if steps, err = internal.NewTrafficSteps(*ec2swapSteps, *ec2swapDuration); err != nil {
+			break
+		}
+		if *ec2swapDryRun {
+			var plan *internal.Plan
+			if plan, err = deployer.PlanSwapTraffic(ctx, steps); err == nil {
+				err = plan.Show("table")
+			}
+			break
+		}
+		err = deployer.SwapTraffic(ctx, steps)
 
 	case ec2traffic.FullCommand():
+		if *ec2trafficDryRun {
+			var plan *internal.Plan
+			if plan, err = deployer.PlanUpdateTraffic(ctx, *ec2trafficBlueWeight, *ec2trafficGreenWeight); err == nil {
+				err = plan.Show("table")
+			}
+			break
+		}
 		err = deployer.UpdateTraffic(ctx, *ec2trafficBlueWeight, *ec2trafficGreenWeight)
 
 	case ec2autoscaling.FullCommand():
+		if *ec2autoscalingDryRun {
+			var plan *internal.Plan
+			if plan, err = deployer.PlanUpdateAutoScalingGroupByTarget(ctx,
+				internal.TargetType(*ec2autoscalingTarget),
+				ec2autoscalingDesired,
+				ec2autoscalingMinSize,
+				ec2autoscalingMaxSize); err == nil {
+				err = plan.Show("table")
+			}
+			break
+		}
 		err = deployer.UpdateAutoScalingGroupByTarget(ctx,
 			internal.TargetType(*ec2autoscalingTarget),
 			ec2autoscalingDesired,
@@ -183,14 +325,51 @@ func main() {
 			ec2autoscalingMaxSize)
 
 	case ec2moveScheduledActions.FullCommand():
+		if *ec2moveScheduledActionsDryRun {
+			var plan *internal.Plan
+			if plan, err = deployer.PlanMoveScheduledActions(ctx, *ec2moveScheduledActionsFrom, *ec2moveScheduledActionsTo); err == nil {
+				err = plan.Show("table")
+			}
+			break
+		}
 		err = deployer.MoveScheduledActions(ctx, *ec2moveScheduledActionsFrom, *ec2moveScheduledActionsTo)
 
+	case ec2abort.FullCommand():
+		if err = deployer.ShowStatus(ctx, "table"); err != nil {
+			break
+		}
+		if *ec2abortSilent == false && internal.AskToContinue() == false {
+			logger.Fatal("🚨 Command Cancelled", nil)
+		}
+		err = deployer.AbortDeploy(ctx)
+
+	case ec2history.FullCommand():
+		err = history.ShowHistory(ctx, *ec2historyOutput, *ec2historyLimit)
+
+	case configValidate.FullCommand():
+		err = checker.Validate(ctx, *configValidateOutput)
+
+	case lockStatus.FullCommand():
+		err = locker.ShowStatus(ctx, *lockStatusOutput)
+
+	case lockRelease.FullCommand():
+		err = locker.Unlock(ctx, *lockReleaseForce)
+
 	default:
 		kingpin.Usage()
 		os.Exit(1)
 	}
 
+	if *verbose {
+		calls := new(strings.Builder)
+		_ = awsClient.CallStats().AsTable(calls)
+		logger.Debug("AWS API calls:\n" + calls.String())
+	}
+
 	if err != nil {
+		if errors.Is(err, internal.CancellationError) || errors.Is(err, context.Canceled) {
+			logger.Fatal("🚨 Command Cancelled", err)
+		}
 		logger.Error("🚨 Command Failure", err)
 		os.Exit(1)
 	}
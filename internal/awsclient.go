@@ -2,35 +2,49 @@ package internal
 
 import (
 	"context"
-	"os"
+	"io"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	asg "github.com/aws/aws-sdk-go-v2/service/autoscaling"
 	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	alb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
 	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
 	"github.com/pkg/errors"
 )
 
 type AwsClient interface {
 	Region() string
 
-	ListS3BucketObjects(ctx context.Context, bucket string, prefix string) ([]s3Types.Object, error)
+	ListS3BucketObjects(ctx context.Context, bucket string, prefix string, continuationToken *string) ([]s3Types.Object, *string, error)
 	HeadS3Bucket(ctx context.Context, bucket string) error
 	CreateS3Bucket(ctx context.Context, bucket string, region string) error
 	EnableS3BucketVersioning(ctx context.Context, bucket string) error
 	MakeS3BucketAclPrivate(ctx context.Context, bucket string) error
 	DisableS3BucketPublicAccess(ctx context.Context, bucket string) error
 	DeleteS3BucketObject(ctx context.Context, bucket string, key string) error
-	PutS3BucketObjectAsBinaryFile(ctx context.Context, bucket string, key string, file *os.File) error
+	UploadS3BucketObject(ctx context.Context, bucket string, key string, body io.Reader, metadata map[string]string) error
+	DownloadS3BucketObject(ctx context.Context, bucket string, key string, etag string, w io.WriterAt) (int64, error)
 	PutS3BucketObjectAsTextFile(ctx context.Context, bucket string, key string, value string) error
+	PutS3BucketObjectAsTextFileIfNotExists(ctx context.Context, bucket string, key string, value string) error
+	PutS3BucketObjectAsTextFileIfMatch(ctx context.Context, bucket string, key string, value string, etag string) error
+	DeleteS3BucketObjectIfMatch(ctx context.Context, bucket string, key string, etag string) error
 	GetS3BucketObject(ctx context.Context, bucket string, key string) (*s3.GetObjectOutput, error)
+	HeadS3BucketObject(ctx context.Context, bucket string, key string) (*s3.HeadObjectOutput, error)
 
 	GetALBListenerRule(ctx context.Context, listenerRuleArn string) (*albTypes.Rule, error)
 	ModifyALBListenerRule(ctx context.Context, listenerRuleArn string, forwardAction *albTypes.ForwardActionConfig) error
@@ -38,51 +52,171 @@ type AwsClient interface {
 	DescribeALBTargetGroup(ctx context.Context, targetGroupArn string) (*albTypes.TargetGroup, error)
 
 	DescribeAutoScalingGroup(ctx context.Context, name string) (*asgTypes.AutoScalingGroup, error)
+	ListAutoScalingGroups(ctx context.Context, nextToken *string) ([]asgTypes.AutoScalingGroup, *string, error)
 	UpdateAutoScalingGroup(ctx context.Context, name string, desiredCapacity *int32, minSize *int32, maxSize *int32) error
-	DescribeScheduledActions(ctx context.Context, name string) ([]asgTypes.ScheduledUpdateGroupAction, error)
+	DescribeScheduledActions(ctx context.Context, name string, nextToken *string) ([]asgTypes.ScheduledUpdateGroupAction, *string, error)
 	PutScheduledUpdateGroupAction(ctx context.Context, name string, action *asgTypes.ScheduledUpdateGroupAction) error
 	DeleteScheduledAction(ctx context.Context, autoScalingGroupName string, scheduledActionName string) error
+
+	DescribeEC2Instances(ctx context.Context, instanceIds []string) ([]ec2Types.Instance, error)
 	GetSSMParameter(ctx context.Context, name string, withDecription bool) (*ssmTypes.Parameter, error)
+	PutSSMParameter(ctx context.Context, name string, value string, overwrite bool) error
+
+	DescribeCloudWatchAlarms(ctx context.Context, alarmNames []string, nextToken *string) (*cloudwatch.DescribeAlarmsOutput, error)
+	GetCloudWatchMetricData(ctx context.Context, queries []cwTypes.MetricDataQuery, startTime time.Time, endTime time.Time) ([]cwTypes.MetricDataResult, error)
+}
+
+// listS3BucketObjects Returns all the objects with the prefix over the pages.
+func listS3BucketObjects(ctx context.Context, client AwsClient, bucket string, prefix string) ([]s3Types.Object, error) {
+	return Paginate(func(token *string) ([]s3Types.Object, *string, error) {
+		return client.ListS3BucketObjects(ctx, bucket, prefix, token)
+	})
+}
+
+// describeScheduledActions Returns all the scheduled actions of the AutoScalingGroup over the pages.
+func describeScheduledActions(ctx context.Context, client AwsClient, name string) ([]asgTypes.ScheduledUpdateGroupAction, error) {
+	return Paginate(func(token *string) ([]asgTypes.ScheduledUpdateGroupAction, *string, error) {
+		return client.DescribeScheduledActions(ctx, name, token)
+	})
+}
+
+// listAutoScalingGroups Returns all the AutoScalingGroups of the region over the pages.
+func listAutoScalingGroups(ctx context.Context, client AwsClient) ([]asgTypes.AutoScalingGroup, error) {
+	return Paginate(func(token *string) ([]asgTypes.AutoScalingGroup, *string, error) {
+		return client.ListAutoScalingGroups(ctx, token)
+	})
+}
+
+// describeCloudWatchAlarms Returns all the metric and composite alarms of the names over the pages.
+func describeCloudWatchAlarms(ctx context.Context, client AwsClient, alarmNames []string) (*cloudwatch.DescribeAlarmsOutput, error) {
+	alarms := &cloudwatch.DescribeAlarmsOutput{}
+	var token *string
+	for {
+		output, err := client.DescribeCloudWatchAlarms(ctx, alarmNames, token)
+		if err != nil {
+			return nil, err
+		}
+		alarms.MetricAlarms = append(alarms.MetricAlarms, output.MetricAlarms...)
+		alarms.CompositeAlarms = append(alarms.CompositeAlarms, output.CompositeAlarms...)
+		if aws.ToString(output.NextToken) == "" {
+			return alarms, nil
+		}
+		token = output.NextToken
+	}
 }
 
 type DefaultAwsClient struct {
-	asg    *asg.Client
-	alb    *alb.Client
-	s3     *s3.Client
-	ssm    *ssm.Client
-	region string
+	asg            *asg.Client
+	alb            *alb.Client
+	s3             *s3.Client
+	ssm            *ssm.Client
+	cw             *cloudwatch.Client
+	ec2            *ec2.Client
+	region         string
+	endpointUrl    string
+	s3UsePathStyle bool
+	awsConfig      aws.Config
+	callStats      *CallStats
 }
 
-func NewDefaultAwsClient(ctx context.Context) (*DefaultAwsClient, error) {
-	region := GetEnv("AWS_REGION", "us-east-1")
-	config, err := awsConfig.LoadDefaultConfig(ctx, awsConfig.WithRegion(region))
+// NewDefaultAwsClient Build the client from the region, role, endpoint and retry policy of the config.
+// The config may be stored in SSM, so it can be nil to build the client that reads it with the ambient credentials and the environment variables.
+// The endpoint can be replaced with DEPLOYMAN_ENDPOINT_URL and DEPLOYMAN_S3_USE_PATH_STYLE, e.g. to run against LocalStack or moto.
+// The calls are counted into callStats, so that the clients of a command can share it. New stats are created if it is nil.
+func NewDefaultAwsClient(ctx context.Context, config *Config, callStats *CallStats) (*DefaultAwsClient, error) {
+	if callStats == nil {
+		callStats = NewCallStats()
+	}
+	client := &DefaultAwsClient{
+		region:         GetEnv("AWS_REGION", "us-east-1"),
+		endpointUrl:    GetEnv("DEPLOYMAN_ENDPOINT_URL", ""),
+		s3UsePathStyle: GetEnv("DEPLOYMAN_S3_USE_PATH_STYLE", "false") == "true",
+		callStats:      callStats,
+	}
+	strategy := newDefaultRetryPolicy().ThrottlingStrategy()
+	if config != nil {
+		if config.Region != "" {
+			client.region = config.Region
+		}
+		if config.EndpointUrl != "" {
+			client.endpointUrl = config.EndpointUrl
+		}
+		if config.S3UsePathStyle {
+			client.s3UsePathStyle = true
+		}
+		strategy = config.RetryPolicy.ThrottlingStrategy()
+	}
+
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx,
+		awsConfig.WithRegion(client.region),
+		awsConfig.WithAPIOptions([]func(*middleware.Stack) error{client.callStats.register}),
+		awsConfig.WithRetryer(func() aws.Retryer {
+			return newAwsRetryer(strategy)
+		}))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	return &DefaultAwsClient{
-		asg:    asg.NewFromConfig(config),
-		alb:    alb.NewFromConfig(config),
-		s3:     s3.NewFromConfig(config),
-		ssm:    ssm.NewFromConfig(config),
-		region: region,
-	}, nil
+	if config != nil && config.RoleArn != "" {
+		// The ambient credentials assume the role, and the temporary credentials are cached until they expire.
+		stsClient := sts.NewFromConfig(awsCfg, func(o *sts.Options) { o.BaseEndpoint = client.baseEndpoint() })
+		provider := stscreds.NewAssumeRoleProvider(stsClient, config.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = config.SessionName
+			if config.ExternalId != "" {
+				o.ExternalID = aws.String(config.ExternalId)
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	client.awsConfig = awsCfg
+	client.newServiceClients()
+	return client, nil
+}
+
+func (c *DefaultAwsClient) baseEndpoint() *string {
+	if c.endpointUrl == "" {
+		return nil
+	}
+	return aws.String(c.endpointUrl)
+}
+
+func (c *DefaultAwsClient) newServiceClients() {
+	baseEndpoint := c.baseEndpoint()
+	c.asg = asg.NewFromConfig(c.awsConfig, func(o *asg.Options) { o.BaseEndpoint = baseEndpoint })
+	c.alb = alb.NewFromConfig(c.awsConfig, func(o *alb.Options) { o.BaseEndpoint = baseEndpoint })
+	c.s3 = s3.NewFromConfig(c.awsConfig, func(o *s3.Options) {
+		o.BaseEndpoint = baseEndpoint
+		o.UsePathStyle = c.s3UsePathStyle
+	})
+	c.ssm = ssm.NewFromConfig(c.awsConfig, func(o *ssm.Options) { o.BaseEndpoint = baseEndpoint })
+	c.cw = cloudwatch.NewFromConfig(c.awsConfig, func(o *cloudwatch.Options) { o.BaseEndpoint = baseEndpoint })
+	c.ec2 = ec2.NewFromConfig(c.awsConfig, func(o *ec2.Options) { o.BaseEndpoint = baseEndpoint })
+}
+
+// CallStats Number of calls per AWS API counted by the client and the others sharing the stats.
+func (c *DefaultAwsClient) CallStats() *CallStats {
+	return c.callStats
 }
 
 func (c *DefaultAwsClient) Region() string {
 	return c.region
 }
 
-func (c *DefaultAwsClient) ListS3BucketObjects(ctx context.Context, bucket string, prefix string) ([]s3Types.Object, error) {
+func (c *DefaultAwsClient) ListS3BucketObjects(ctx context.Context, bucket string, prefix string, continuationToken *string) ([]s3Types.Object, *string, error) {
 	output, err := c.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket: &bucket,
-		Prefix: &prefix,
+		Bucket:            &bucket,
+		Prefix:            &prefix,
+		ContinuationToken: continuationToken,
 	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
 	}
 
-	return output.Contents, nil
+	if !aws.ToBool(output.IsTruncated) {
+		return output.Contents, nil, nil
+	}
+	return output.Contents, output.NextContinuationToken, nil
 }
 
 func (c *DefaultAwsClient) HeadS3Bucket(ctx context.Context, bucket string) error {
@@ -163,11 +297,18 @@ func (c *DefaultAwsClient) DeleteS3BucketObject(ctx context.Context, bucket stri
 	return nil
 }
 
-func (c *DefaultAwsClient) PutS3BucketObjectAsBinaryFile(ctx context.Context, bucket string, key string, file *os.File) error {
-	_, err := c.s3.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-		Body:   file,
+// UploadS3BucketObject Upload in TransferPartSize parts concurrently, so that the body larger than 5 GB can be uploaded.
+// The parts are read directly if the body is io.ReaderAt and io.Seeker, and buffered otherwise.
+func (c *DefaultAwsClient) UploadS3BucketObject(ctx context.Context, bucket string, key string, body io.Reader, metadata map[string]string) error {
+	uploader := manager.NewUploader(c.s3, func(u *manager.Uploader) {
+		u.PartSize = TransferPartSize
+		u.Concurrency = TransferConcurrency
+	})
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:   &bucket,
+		Key:      &key,
+		Body:     body,
+		Metadata: metadata,
 	})
 	if err != nil {
 		return errors.WithStack(err)
@@ -176,6 +317,25 @@ func (c *DefaultAwsClient) PutS3BucketObjectAsBinaryFile(ctx context.Context, bu
 	return nil
 }
 
+// DownloadS3BucketObject Download in TransferPartSize ranges concurrently, and write them at their offsets.
+// The etag makes sure that every range is of the same version of the object.
+func (c *DefaultAwsClient) DownloadS3BucketObject(ctx context.Context, bucket string, key string, etag string, w io.WriterAt) (int64, error) {
+	downloader := manager.NewDownloader(c.s3, func(d *manager.Downloader) {
+		d.PartSize = TransferPartSize
+		d.Concurrency = TransferConcurrency
+	})
+	n, err := downloader.Download(ctx, w, &s3.GetObjectInput{
+		Bucket:  &bucket,
+		Key:     &key,
+		IfMatch: &etag,
+	})
+	if err != nil {
+		return n, errors.WithStack(err)
+	}
+
+	return n, nil
+}
+
 func (c *DefaultAwsClient) PutS3BucketObjectAsTextFile(ctx context.Context, bucket string, key string, value string) error {
 	_, err := c.s3.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:      &bucket,
@@ -190,6 +350,49 @@ func (c *DefaultAwsClient) PutS3BucketObjectAsTextFile(ctx context.Context, buck
 	return nil
 }
 
+func (c *DefaultAwsClient) PutS3BucketObjectAsTextFileIfNotExists(ctx context.Context, bucket string, key string, value string) error {
+	_, err := c.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		ContentType: aws.String("text/plain"),
+		Body:        strings.NewReader(value),
+		IfNoneMatch: aws.String("*"),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (c *DefaultAwsClient) PutS3BucketObjectAsTextFileIfMatch(ctx context.Context, bucket string, key string, value string, etag string) error {
+	_, err := c.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		ContentType: aws.String("text/plain"),
+		Body:        strings.NewReader(value),
+		IfMatch:     &etag,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (c *DefaultAwsClient) DeleteS3BucketObjectIfMatch(ctx context.Context, bucket string, key string, etag string) error {
+	_, err := c.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  &bucket,
+		Key:     &key,
+		IfMatch: &etag,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
 func (c *DefaultAwsClient) GetS3BucketObject(ctx context.Context, bucket string, key string) (*s3.GetObjectOutput, error) {
 	output, err := c.s3.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &bucket,
@@ -202,6 +405,18 @@ func (c *DefaultAwsClient) GetS3BucketObject(ctx context.Context, bucket string,
 	return output, nil
 }
 
+func (c *DefaultAwsClient) HeadS3BucketObject(ctx context.Context, bucket string, key string) (*s3.HeadObjectOutput, error) {
+	output, err := c.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return output, nil
+}
+
 func (c *DefaultAwsClient) GetALBListenerRule(ctx context.Context, listenerRuleArn string) (*albTypes.Rule, error) {
 	output, err := c.alb.DescribeRules(ctx, &alb.DescribeRulesInput{
 		RuleArns: []string{listenerRuleArn}})
@@ -229,8 +444,22 @@ func (c *DefaultAwsClient) DescribeAutoScalingGroup(ctx context.Context, name st
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if len(output.AutoScalingGroups) == 0 {
+		return nil, errors.Errorf("AutoScalingGroup not found. name:%s", name)
+	}
 
-	return &output.AutoScalingGroups[0], err
+	return &output.AutoScalingGroups[0], nil
+}
+
+func (c *DefaultAwsClient) ListAutoScalingGroups(ctx context.Context, nextToken *string) ([]asgTypes.AutoScalingGroup, *string, error) {
+	output, err := c.asg.DescribeAutoScalingGroups(ctx, &asg.DescribeAutoScalingGroupsInput{
+		NextToken: nextToken,
+	})
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return output.AutoScalingGroups, output.NextToken, nil
 }
 
 func (c *DefaultAwsClient) DescribeALBTargetGroup(ctx context.Context, targetGroupArn string) (*albTypes.TargetGroup, error) {
@@ -280,15 +509,16 @@ func (c *DefaultAwsClient) UpdateAutoScalingGroup(ctx context.Context, name stri
 	return nil
 }
 
-func (c *DefaultAwsClient) DescribeScheduledActions(ctx context.Context, name string) ([]asgTypes.ScheduledUpdateGroupAction, error) {
+func (c *DefaultAwsClient) DescribeScheduledActions(ctx context.Context, name string, nextToken *string) ([]asgTypes.ScheduledUpdateGroupAction, *string, error) {
 	output, err := c.asg.DescribeScheduledActions(ctx, &asg.DescribeScheduledActionsInput{
 		AutoScalingGroupName: &name,
+		NextToken:            nextToken,
 	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
 	}
 
-	return output.ScheduledUpdateGroupActions, err
+	return output.ScheduledUpdateGroupActions, output.NextToken, nil
 }
 
 func (c *DefaultAwsClient) PutScheduledUpdateGroupAction(ctx context.Context, name string, action *asgTypes.ScheduledUpdateGroupAction) error {
@@ -323,6 +553,28 @@ func (c *DefaultAwsClient) DeleteScheduledAction(ctx context.Context, autoScalin
 	return nil
 }
 
+// DescribeEC2Instances Returns the instances of the IDs over the pages.
+func (c *DefaultAwsClient) DescribeEC2Instances(ctx context.Context, instanceIds []string) ([]ec2Types.Instance, error) {
+	var instances []ec2Types.Instance
+	var nextToken *string
+	for {
+		output, err := c.ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: instanceIds,
+			NextToken:   nextToken,
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, reservation := range output.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+		if output.NextToken == nil {
+			return instances, nil
+		}
+		nextToken = output.NextToken
+	}
+}
+
 func (c *DefaultAwsClient) GetSSMParameter(ctx context.Context, name string, withDecription bool) (*ssmTypes.Parameter, error) {
 	output, err := c.ssm.GetParameter(ctx, &ssm.GetParameterInput{
 		Name:           aws.String(name),
@@ -334,3 +586,53 @@ func (c *DefaultAwsClient) GetSSMParameter(ctx context.Context, name string, wit
 
 	return output.Parameter, nil
 }
+
+func (c *DefaultAwsClient) PutSSMParameter(ctx context.Context, name string, value string, overwrite bool) error {
+	_, err := c.ssm.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(name),
+		Value:     aws.String(value),
+		Type:      ssmTypes.ParameterTypeString,
+		Overwrite: aws.Bool(overwrite),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (c *DefaultAwsClient) DescribeCloudWatchAlarms(ctx context.Context, alarmNames []string, nextToken *string) (*cloudwatch.DescribeAlarmsOutput, error) {
+	output, err := c.cw.DescribeAlarms(ctx, &cloudwatch.DescribeAlarmsInput{
+		AlarmNames: alarmNames,
+		AlarmTypes: []cwTypes.AlarmType{cwTypes.AlarmTypeMetricAlarm, cwTypes.AlarmTypeCompositeAlarm},
+		MaxRecords: aws.Int32(100),
+		NextToken:  nextToken,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return output, nil
+}
+
+func (c *DefaultAwsClient) GetCloudWatchMetricData(ctx context.Context, queries []cwTypes.MetricDataQuery, startTime time.Time, endTime time.Time) ([]cwTypes.MetricDataResult, error) {
+	var results []cwTypes.MetricDataResult
+	var nextToken *string
+	for {
+		output, err := c.cw.GetMetricData(ctx, &cloudwatch.GetMetricDataInput{
+			MetricDataQueries: queries,
+			StartTime:         &startTime,
+			EndTime:           &endTime,
+			NextToken:         nextToken,
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		results = append(results, output.MetricDataResults...)
+
+		if output.NextToken == nil {
+			return results, nil
+		}
+		nextToken = output.NextToken
+	}
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsMiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+type ErrorClass string
+
+const (
+	ErrorClassRetryable ErrorClass = "retryable"
+	ErrorClassThrottled ErrorClass = "throttled"
+	ErrorClassFatal     ErrorClass = "fatal"
+)
+
+// ClassifyError Whether the error of an AWS API call is worth retrying.
+// Throttled errors are rejected by the rate limit, retryable errors are transient such as 5xx and connection errors,
+// and the others including the cancellation are fatal.
+func ClassifyError(err error) ErrorClass {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassFatal
+	}
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err).Bool() {
+		return ErrorClassThrottled
+	}
+	if retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err).Bool() {
+		return ErrorClassRetryable
+	}
+	return ErrorClassFatal
+}
+
+// newAwsRetryer Retryer of the AWS SDK that retries the retryable and throttled errors by the strategy.
+func newAwsRetryer(strategy *RetryStrategy) aws.Retryer {
+	maxAttempts := strategy.MaxLimit
+	if strategy.Type == RetryTypeDeadline && strategy.IntervalSeconds > 0 {
+		maxAttempts = strategy.TimeoutSeconds/strategy.IntervalSeconds + 1
+	}
+	backoff := NewExponentialRetryer(
+		maxAttempts,
+		time.Duration(strategy.IntervalSeconds)*time.Second,
+		time.Duration(strategy.MaxIntervalSeconds)*time.Second,
+		strategy.Multiplier,
+		strategy.Type == RetryTypeJitter)
+
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = max(maxAttempts, 1)
+		o.MaxBackoff = time.Duration(strategy.MaxIntervalSeconds) * time.Second
+		o.Backoff = retry.BackoffDelayerFunc(func(attempt int, err error) (time.Duration, error) {
+			if strategy.Type == RetryTypeExponential || strategy.Type == RetryTypeJitter {
+				return backoff.Interval(attempt - 1), nil
+			}
+			return time.Duration(strategy.IntervalSeconds) * time.Second, nil
+		})
+		o.Retryables = []retry.IsErrorRetryable{
+			retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+				return aws.BoolTernary(ClassifyError(err) != ErrorClassFatal)
+			}),
+		}
+		// The strategy limits the retries, so do not share a retry quota across the calls.
+		o.RateLimiter = ratelimit.None
+	})
+}
+
+type CallStat struct {
+	API       string
+	Calls     int
+	Attempts  int
+	Retryable int
+	Throttled int
+	Fatal     int
+}
+
+// CallStats Number of calls per AWS API, counted by the middleware of the AWS SDK clients.
+type CallStats struct {
+	mu    sync.Mutex
+	stats map[string]*CallStat
+}
+
+func NewCallStats() *CallStats {
+	return &CallStats{stats: map[string]*CallStat{}}
+}
+
+func (s *CallStats) count(ctx context.Context, f func(stat *CallStat)) {
+	api := awsMiddleware.GetServiceID(ctx) + "." + awsMiddleware.GetOperationName(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat, ok := s.stats[api]
+	if !ok {
+		stat = &CallStat{API: api}
+		s.stats[api] = stat
+	}
+	f(stat)
+}
+
+// List Returns the stats sorted by API.
+func (s *CallStats) List() []CallStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats []CallStat
+	for _, stat := range s.stats {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].API < stats[j].API
+	})
+	return stats
+}
+
+func (s *CallStats) AsTable(w io.Writer) error {
+	var data [][]string
+	for _, stat := range s.List() {
+		data = append(data, []string{
+			stat.API,
+			strconv.Itoa(stat.Calls),
+			strconv.Itoa(stat.Attempts),
+			strconv.Itoa(stat.Retryable),
+			strconv.Itoa(stat.Throttled),
+			strconv.Itoa(stat.Fatal),
+		})
+	}
+
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"api", "calls", "attempts", "retryable", "throttled", "fatal"})
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+// register Add the middleware to the stack of every AWS API call.
+// The calls are counted before the retries, and the attempts and their errors after each retry.
+func (s *CallStats) register(stack *middleware.Stack) error {
+	countCalls := middleware.InitializeMiddlewareFunc("deployman/CountCalls",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			s.count(ctx, func(stat *CallStat) { stat.Calls++ })
+			return next.HandleInitialize(ctx, in)
+		})
+	if err := stack.Initialize.Add(countCalls, middleware.After); err != nil {
+		return errors.WithStack(err)
+	}
+
+	countAttempts := middleware.FinalizeMiddlewareFunc("deployman/CountAttempts",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			s.count(ctx, func(stat *CallStat) {
+				stat.Attempts++
+				if err == nil {
+					return
+				}
+				switch ClassifyError(err) {
+				case ErrorClassRetryable:
+					stat.Retryable++
+				case ErrorClassThrottled:
+					stat.Throttled++
+				default:
+					stat.Fatal++
+				}
+			})
+			return out, metadata, err
+		})
+	if err := stack.Finalize.Insert(countAttempts, (&retry.Attempt{}).ID(), middleware.After); err != nil {
+		if err := stack.Finalize.Add(countAttempts, middleware.After); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
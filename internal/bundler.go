@@ -1,17 +1,25 @@
 package internal
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/olekukonko/tablewriter"
@@ -21,13 +29,22 @@ import (
 const (
 	BundlePrefix          string = "bundles/"
 	ActiveBundleKeyPrefix string = "active_bundle_"
-	MaxKeepBundles        int    = 100
+	// BundleHeadConcurrency Number of the bundles whose labels are fetched at the same time by 'bundle list'.
+	BundleHeadConcurrency int = 8
+	MaxKeepBundles        int = 100
+	// ChecksumSuffix Suffix of the sidecar manifest of the bundle in the 'sha256sum' format.
+	ChecksumSuffix string = ".sha256"
+	// ChecksumMetadataKey Object metadata of the bundle, i.e. 'x-amz-meta-sha256'.
+	ChecksumMetadataKey string = "sha256"
 )
 
+var ChecksumError = errors.New("ChecksumError")
+
 type Bundler struct {
 	config *Config
 	client AwsClient
 	logger Logger
+	locker *Locker
 }
 
 type ActiveBundle struct {
@@ -36,15 +53,19 @@ type ActiveBundle struct {
 }
 
 type BundleListItem struct {
-	Number        int      `json:"number"`
-	LastUpdated   string   `json:"lastUpdated"`
-	BundleName    string   `json:"bundleName"`
-	ActiveTargets []string `json:"activeTargets"`
+	// Number Position in the unfiltered list from the latest, so that it points the same bundle whatever the filters are.
+	Number        int               `json:"number"`
+	LastUpdated   string            `json:"lastUpdated"`
+	BundleName    string            `json:"bundleName"`
+	Sha256        string            `json:"sha256"`
+	Labels        map[string]string `json:"labels"`
+	ActiveTargets []string          `json:"activeTargets"`
 }
 
 type BundleListOutput struct {
 	BucketName string           `json:"bucket"`
 	Bundles    []BundleListItem `json:"bundles"`
+	columns    []string
 }
 
 func (b *BundleListOutput) AsJSON(w io.Writer) error {
@@ -60,17 +81,30 @@ func (b *BundleListOutput) AsTable(w io.Writer) error {
 		if len(item.ActiveTargets) > 0 {
 			status = "active:[" + strings.Join(item.ActiveTargets, ", ") + "]"
 		}
-		data = append(data, []string{
+		checksum := item.Sha256
+		if len(checksum) > 12 {
+			checksum = checksum[:12]
+		}
+		row := []string{
 			strconv.Itoa(item.Number),
 			item.LastUpdated,
 			item.BundleName,
-			status,
-		})
+			checksum,
+		}
+		for _, column := range b.columns {
+			value := item.Labels[column]
+			if column == LabelGitCommit && len(value) > 12 {
+				value = value[:12]
+			}
+			row = append(row, value)
+		}
+		data = append(data, append(row, status))
 	}
 
 	fmt.Fprintf(w, "Bucket: %s\n", b.BucketName)
 	table := tablewriter.NewWriter(w)
-	table.SetHeader([]string{"#", "last updated", "bundle name", "status"})
+	header := append([]string{"#", "last updated", "bundle name", "sha256"}, b.columns...)
+	table.SetHeader(append(header, "status"))
 	table.AppendBulk(data)
 	table.Render()
 
@@ -82,14 +116,23 @@ func NewBundler(deployConfig *Config, awsClient AwsClient, logger Logger) *Bundl
 		config: deployConfig,
 		client: awsClient,
 		logger: logger,
+		locker: NewLocker(deployConfig, awsClient, logger),
 	}
 }
 
+// isBundleSidecar Whether the object is stored beside the bundle, such as the checksum manifest and the signature.
+func isBundleSidecar(key string) bool {
+	return strings.HasSuffix(key, ChecksumSuffix) || strings.HasSuffix(key, SignatureSuffix)
+}
+
 func (b *Bundler) listBundles(ctx context.Context, bucket string) ([]s3Types.Object, error) {
-	objects, err := b.client.ListS3BucketObjects(ctx, bucket, BundlePrefix)
+	objects, err := listS3BucketObjects(ctx, b.client, bucket, BundlePrefix)
 	if err != nil {
 		return nil, err
 	}
+	objects = Filter(objects, func(o *s3Types.Object) bool {
+		return !isBundleSidecar(*o.Key)
+	})
 
 	// desc sort
 	sort.Slice(objects, func(i, j int) bool {
@@ -99,7 +142,37 @@ func (b *Bundler) listBundles(ctx context.Context, bucket string) ([]s3Types.Obj
 	return objects, nil
 }
 
-func (b *Bundler) ListBundles(ctx context.Context, outputFormat string) error {
+// headBundles Get the metadata of the bundles concurrently by BundleHeadConcurrency requests at a time.
+// The heads are in the same order as the objects.
+func (b *Bundler) headBundles(ctx context.Context, objects []s3Types.Object) ([]*s3.HeadObjectOutput, error) {
+	heads := make([]*s3.HeadObjectOutput, len(objects))
+	errs := make([]error, len(objects))
+	slots := make(chan struct{}, BundleHeadConcurrency)
+	var wg sync.WaitGroup
+	for i, object := range objects {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			heads[i], errs[i] = b.client.HeadS3BucketObject(ctx, b.config.BundleBucket, *object.Key)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return heads, nil
+}
+
+// ListBundles Show the bundles from the latest with the labels of the columns. Only the bundles that have all the filters are shown,
+// and they keep the numbers of the unfiltered list.
+func (b *Bundler) ListBundles(ctx context.Context, outputFormat string, columns []string, filters map[string]string) error {
 	getActiveBundleOrNil := func(targetType TargetType) (*ActiveBundle, error) {
 		bundle, err := b.getActiveBundle(ctx, targetType)
 		if err != nil {
@@ -127,6 +200,11 @@ func (b *Bundler) ListBundles(ctx context.Context, outputFormat string) error {
 		return err
 	}
 
+	heads, err := b.headBundles(ctx, bundleObjects)
+	if err != nil {
+		return err
+	}
+
 	var bundles []BundleListItem
 	for i, bundleObject := range bundleObjects {
 		var targets []string
@@ -139,11 +217,18 @@ func (b *Bundler) ListBundles(ctx context.Context, outputFormat string) error {
 		location := b.config.TimeZone.CurrentLocation()
 		lastUpdated := bundleObject.LastModified.In(location).Format(time.RFC3339)
 		bundleName := strings.Replace(*bundleObject.Key, BundlePrefix, "", 1)
+		head := heads[i]
+		labels := decodeLabels(head.Metadata)
+		if !matchLabels(labels, filters) {
+			continue
+		}
 
 		bundles = append(bundles, BundleListItem{
 			Number:        i + 1,
 			LastUpdated:   lastUpdated,
 			BundleName:    bundleName,
+			Sha256:        head.Metadata[ChecksumMetadataKey],
+			Labels:        labels,
 			ActiveTargets: targets,
 		})
 	}
@@ -152,6 +237,11 @@ func (b *Bundler) ListBundles(ctx context.Context, outputFormat string) error {
 		BucketName: b.config.BundleBucket,
 		Bundles:    bundles,
 	}
+	for _, column := range columns {
+		if column = strings.ToLower(strings.TrimSpace(column)); column != "" {
+			output.columns = append(output.columns, column)
+		}
+	}
 
 	if outputFormat == "json" {
 		return output.AsJSON(os.Stdout)
@@ -159,7 +249,27 @@ func (b *Bundler) ListBundles(ctx context.Context, outputFormat string) error {
 	return output.AsTable(os.Stdout)
 }
 
-func (b *Bundler) Register(ctx context.Context, uploadFile string, bundleName string) error {
+// Register Upload the bundle with its checksum and labels. The git commit, branch, author and the build URL are detected,
+// and the given labels take precedence over them. The bundle is signed if the signing key is given.
+func (b *Bundler) Register(ctx context.Context, uploadFile string, bundleName string, signKeyFile string, labels map[string]string) error {
+	labels, err := normalizeLabels(labels)
+	if err != nil {
+		return err
+	}
+	detected := detectLabels(ctx)
+	for key, value := range labels {
+		detected[key] = value
+	}
+	labels = detected
+
+	var signKey ed25519.PrivateKey
+	if signKeyFile != "" {
+		var err error
+		if signKey, err = LoadSigningKey(signKeyFile); err != nil {
+			return err
+		}
+	}
+
 	createBucketIfNotExsists := func() error {
 		err := b.client.HeadS3Bucket(ctx, b.config.BundleBucket)
 		var apiErr smithy.APIError
@@ -193,6 +303,11 @@ func (b *Bundler) Register(ctx context.Context, uploadFile string, bundleName st
 				if err := b.client.DeleteS3BucketObject(ctx, b.config.BundleBucket, *o.Key); err != nil {
 					return err
 				}
+				for _, suffix := range []string{ChecksumSuffix, SignatureSuffix} {
+					if err := b.client.DeleteS3BucketObject(ctx, b.config.BundleBucket, *o.Key+suffix); err != nil {
+						return err
+					}
+				}
 			}
 		}
 
@@ -211,16 +326,75 @@ func (b *Bundler) Register(ctx context.Context, uploadFile string, bundleName st
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	defer file.Close()
 
-	if err := b.client.PutS3BucketObjectAsBinaryFile(ctx, b.config.BundleBucket, BundlePrefix+bundleName, file); err != nil {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	info, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	key := BundlePrefix + bundleName
+	metadata := encodeLabels(labels)
+	metadata[ChecksumMetadataKey] = checksum
+	uploading := newProgress(fmt.Sprintf("Uploading %s", bundleName), info.Size())
+	err = b.client.UploadS3BucketObject(ctx, b.config.BundleBucket, key, &progressReader{file: file, progress: uploading}, metadata)
+	uploading.finish()
+	if err != nil {
+		return err
+	}
+	// The manifest can be checked with 'sha256sum -c' next to the downloaded bundle.
+	manifest := fmt.Sprintf("%s  %s\n", checksum, bundleName)
+	if err := b.client.PutS3BucketObjectAsTextFile(ctx, b.config.BundleBucket, key+ChecksumSuffix, manifest); err != nil {
 		return err
 	}
+	if signKey != nil {
+		signature, err := signChecksum(signKey, checksum)
+		if err != nil {
+			return err
+		}
+		if err := b.client.PutS3BucketObjectAsTextFile(ctx, b.config.BundleBucket, key+SignatureSuffix, signature); err != nil {
+			return err
+		}
+		b.logger.Info(fmt.Sprintf("'%s' signed.", bundleName))
+	}
+	b.logger.Info(fmt.Sprintf("'%s' registered. sha256:%s", bundleName, checksum))
 
 	return nil
 }
 
+// getChecksum Returns the SHA-256 in the manifest of the bundle, or empty if the bundle was registered without it.
+func (b *Bundler) getChecksum(ctx context.Context, key string) (string, error) {
+	output, err := b.client.GetS3BucketObject(ctx, b.config.BundleBucket, key+ChecksumSuffix)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return "", nil
+		}
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(output.Body); err != nil {
+		return "", errors.WithStack(err)
+	}
+	checksum, _, _ := strings.Cut(buf.String(), " ")
+	return strings.TrimSpace(checksum), nil
+}
+
 func (b *Bundler) getActiveBundle(ctx context.Context, targetType TargetType) (*ActiveBundle, error) {
-	output, err := b.client.GetS3BucketObject(ctx, b.config.BundleBucket, ActiveBundleKeyPrefix+string(targetType))
+	return getActiveBundle(ctx, b.client, b.config.BundleBucket, targetType)
+}
+
+func getActiveBundle(ctx context.Context, client AwsClient, bucket string, targetType TargetType) (*ActiveBundle, error) {
+	output, err := client.GetS3BucketObject(ctx, bucket, ActiveBundleKeyPrefix+string(targetType))
 	if err != nil {
 		return nil, err
 	}
@@ -238,6 +412,25 @@ func (b *Bundler) getActiveBundle(ctx context.Context, targetType TargetType) (*
 }
 
 func (b *Bundler) Activate(ctx context.Context, targetType TargetType, bundleValue string) error {
+	if err := b.locker.Acquire(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err := b.locker.Release(context.WithoutCancel(ctx)); err != nil {
+			b.logger.Warn("Failed to release the lock. Check it with the 'lock status' command.", err)
+		}
+	}()
+
+	// Only the signed bundle can be pointed to, so the instances never run an unsigned one.
+	bundleKey := BundlePrefix + bundleValue
+	checksum, err := b.getChecksum(ctx, bundleKey)
+	if err != nil {
+		return err
+	}
+	if err := b.verifySignature(ctx, bundleKey, checksum); err != nil {
+		return err
+	}
+
 	key := ActiveBundleKeyPrefix + string(targetType)
 	b.logger.Info(fmt.Sprintf("'%s' registered in 's3://%s/%s'", bundleValue, b.config.BundleBucket, key))
 	if err := b.client.PutS3BucketObjectAsTextFile(ctx, b.config.BundleBucket, key, bundleValue); err != nil {
@@ -247,27 +440,210 @@ func (b *Bundler) Activate(ctx context.Context, targetType TargetType, bundleVal
 	return nil
 }
 
-func (b *Bundler) Download(ctx context.Context, targetType TargetType) error {
-	bundle, err := b.getActiveBundle(ctx, targetType)
+// Download Download the bundle active in the target, or the registered bundle of the name.
+// The bundle is written to the output, which is the bundle name in the current directory by default, a file or directory path, or '-' for stdout.
+// With extractDir, the bundle is unzipped into it instead. Nothing is written until the bundle is verified.
+func (b *Bundler) Download(ctx context.Context, targetType TargetType, bundleName string, output string, extractDir string) error {
+	if (targetType == "") == (bundleName == "") {
+		return errors.New("Specify either the target or the name of the bundle to download.")
+	}
+	if output != "" && extractDir != "" {
+		return errors.New("The output and the extract directory cannot be specified together.")
+	}
+
+	if targetType != "" {
+		bundle, err := b.getActiveBundle(ctx, targetType)
+		if err != nil {
+			return err
+		}
+		bundleName = bundle.Value
+	}
+	key := BundlePrefix + bundleName
+	head, err := b.client.HeadS3BucketObject(ctx, b.config.BundleBucket, key)
 	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
+			return errors.Errorf("'%s' is not registered. Valid names can be checked with the 'bundle list' command.", bundleName)
+		}
 		return err
 	}
 
-	output, err := b.client.GetS3BucketObject(ctx, b.config.BundleBucket, BundlePrefix+bundle.Value)
+	switch {
+	case extractDir != "":
+		file, err := b.downloadVerified(ctx, key, head, "")
+		if err != nil {
+			return err
+		}
+		defer removeTemp(file)
+		count, err := extractZip(file, aws.ToInt64(head.ContentLength), extractDir)
+		if err != nil {
+			return err
+		}
+		b.logger.Info(fmt.Sprintf("'%s' extracted into '%s'. files:%d", bundleName, extractDir, count))
+
+	case output == "-":
+		file, err := b.downloadVerified(ctx, key, head, "")
+		if err != nil {
+			return err
+		}
+		defer removeTemp(file)
+		if _, err := io.Copy(os.Stdout, file); err != nil {
+			return errors.WithStack(err)
+		}
+
+	default:
+		if output == "" {
+			output = bundleName
+		} else if info, err := os.Stat(output); err == nil && info.IsDir() {
+			output = filepath.Join(output, filepath.Base(bundleName))
+		}
+		// The temporary file is next to the output, so that it is renamed to the output atomically.
+		file, err := b.downloadVerified(ctx, key, head, filepath.Dir(output))
+		if err != nil {
+			return err
+		}
+		defer removeTemp(file)
+		if err := file.Chmod(0644); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := file.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := os.Rename(file.Name(), output); err != nil {
+			return errors.WithStack(err)
+		}
+		b.logger.Info(fmt.Sprintf("'%s' downloaded to '%s'.", bundleName, output))
+	}
+
+	return nil
+}
+
+// downloadVerified Stream the bundle to a temporary file in the directory, or in the system temporary directory if it is empty.
+// The file is returned at the start only after the checksum and the signature are verified. The caller removes it with removeTemp.
+func (b *Bundler) downloadVerified(ctx context.Context, key string, head *s3.HeadObjectOutput, dir string) (*os.File, error) {
+	file, err := os.CreateTemp(dir, filepath.Base(key)+".*.part")
 	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	verify := func() error {
+		downloading := newProgress(fmt.Sprintf("Downloading %s", strings.TrimPrefix(key, BundlePrefix)), aws.ToInt64(head.ContentLength))
+		_, err := b.client.DownloadS3BucketObject(ctx, b.config.BundleBucket, key, aws.ToString(head.ETag), &progressWriter{file: file, progress: downloading})
+		downloading.finish()
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return errors.WithStack(err)
+		}
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		if err := b.verifyChecksum(ctx, key, head.Metadata, checksum); err != nil {
+			return err
+		}
+		if err := b.verifySignature(ctx, key, checksum); err != nil {
+			return err
+		}
+
+		_, err = file.Seek(0, io.SeekStart)
 		return errors.WithStack(err)
 	}
+	if err := verify(); err != nil {
+		removeTemp(file)
+		return nil, err
+	}
+	return file, nil
+}
 
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(output.Body)
+func removeTemp(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
+
+// extractZip Unzip the bundle into the directory, and returns the number of the files.
+// The entries outside of the directory and the symbolic links are rejected, as the bundle may come from anyone who can register.
+func extractZip(file *os.File, size int64, dir string) (int, error) {
+	reader, err := zip.NewReader(file, size)
 	if err != nil {
-		return errors.WithStack(err)
+		return 0, errors.Wrap(err, "The bundle cannot be extracted as a zip file.")
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	extract := func(entry *zip.File, path string) error {
+		mode := entry.Mode().Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		src, err := entry.Open()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			_ = dst.Close()
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(dst.Close())
 	}
 
-	err = os.WriteFile(bundle.Value, buf.Bytes(), 0755)
+	count := 0
+	for _, entry := range reader.File {
+		path := filepath.Join(root, entry.Name)
+		if path != root && !strings.HasPrefix(path, root+string(os.PathSeparator)) {
+			return count, errors.Errorf("'%s' in the bundle is outside of the extract directory.", entry.Name)
+		}
+		if entry.Mode()&os.ModeSymlink != 0 {
+			return count, errors.Errorf("'%s' in the bundle is a symbolic link, which is not extracted.", entry.Name)
+		}
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return count, errors.WithStack(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return count, errors.WithStack(err)
+		}
+		if err := extract(entry, path); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// verifyChecksum Compare the SHA-256 of the downloaded bundle with the metadata and the manifest recorded at register.
+// Returns ChecksumError on mismatch. The bundle registered without them is only warned.
+func (b *Bundler) verifyChecksum(ctx context.Context, key string, metadata map[string]string, actual string) error {
+	manifest, err := b.getChecksum(ctx, key)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
+	}
+	expected := map[string]string{
+		"metadata": metadata[ChecksumMetadataKey],
+		"manifest": manifest,
+	}
+	if expected["metadata"] == "" && expected["manifest"] == "" {
+		b.logger.Warn(fmt.Sprintf("'%s' has no checksum, so it is not verified. Register it again to record the checksum.", key), nil)
+		return nil
+	}
+	for _, source := range []string{"metadata", "manifest"} {
+		if expected[source] != "" && !strings.EqualFold(expected[source], actual) {
+			return errors.Wrapf(ChecksumError, "The SHA-256 of '%s' does not match the %s. expected:%s, actual:%s", key, source, expected[source], actual)
+		}
 	}
 
+	b.logger.Info(fmt.Sprintf("'%s' verified. sha256:%s", key, actual))
 	return nil
 }
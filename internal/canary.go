@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+const (
+	CanaryVerdictPass         = "pass"
+	CanaryVerdictFail         = "fail"
+	CanaryVerdictInconclusive = "inconclusive"
+)
+
+var CanaryError = errors.New("CanaryError")
+
+type CanaryMetrics struct {
+	TargetType     string  `json:"target"`
+	Role           string  `json:"role"`
+	RequestCount   float64 `json:"requestCount"`
+	Target5XXCount float64 `json:"target5xxCount"`
+	ResponseTime   float64 `json:"responseTime"`
+}
+
+// Target5XXRate Percentage of 5XX responses to all requests.
+func (m *CanaryMetrics) Target5XXRate() float64 {
+	if m.RequestCount <= 0 {
+		return 0
+	}
+	return m.Target5XXCount * 100 / m.RequestCount
+}
+
+type CanaryReport struct {
+	StartTime time.Time       `json:"startTime"`
+	EndTime   time.Time       `json:"endTime"`
+	Metrics   []CanaryMetrics `json:"metrics"`
+	Verdict   string          `json:"verdict"`
+	Reason    string          `json:"reason"`
+	location  *time.Location
+}
+
+func (r *CanaryReport) AsTable(w io.Writer) error {
+	var data [][]string
+	for _, metrics := range r.Metrics {
+		data = append(data, []string{
+			metrics.TargetType,
+			metrics.Role,
+			strconv.FormatFloat(metrics.RequestCount, 'f', 0, 64),
+			strconv.FormatFloat(metrics.Target5XXCount, 'f', 0, 64),
+			strconv.FormatFloat(metrics.Target5XXRate(), 'f', 2, 64),
+			strconv.FormatFloat(metrics.ResponseTime*1000, 'f', 1, 64),
+		})
+	}
+
+	fmt.Fprintf(w, "Canary analysis: %s - %s\n",
+		r.StartTime.In(r.location).Format(time.RFC3339),
+		r.EndTime.In(r.location).Format(time.RFC3339))
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"target", "role", "requests", "5xx", "5xx(%)", "response time(ms)"})
+	table.AppendBulk(data)
+	table.Render()
+	fmt.Fprintf(w, "Verdict: %s (%s)\n", r.Verdict, r.Reason)
+
+	return nil
+}
+
+// judge Compare the new target with the old one by the thresholds of CanaryAnalysis.
+func (r *CanaryReport) judge(config *CanaryAnalysis) {
+	next, prev := &r.Metrics[0], &r.Metrics[1]
+
+	if next.RequestCount < float64(config.MinRequestCount) {
+		r.Verdict = CanaryVerdictInconclusive
+		r.Reason = fmt.Sprintf("the new target received %.0f requests, less than %d", next.RequestCount, config.MinRequestCount)
+		return
+	}
+
+	if diff := next.Target5XXRate() - prev.Target5XXRate(); diff > config.Max5XXRateDiff {
+		r.Verdict = CanaryVerdictFail
+		r.Reason = fmt.Sprintf("5xx rate is %.2f points higher than the old target, more than %.2f", diff, config.Max5XXRateDiff)
+		return
+	}
+
+	if prev.ResponseTime > 0 {
+		if ratio := next.ResponseTime / prev.ResponseTime; ratio > config.MaxResponseTimeRatio {
+			r.Verdict = CanaryVerdictFail
+			r.Reason = fmt.Sprintf("response time is %.2f times the old target, more than %.2f", ratio, config.MaxResponseTimeRatio)
+			return
+		}
+	}
+
+	r.Verdict = CanaryVerdictPass
+	r.Reason = "within the thresholds"
+}
+
+// arnResource Returns the resource part of ARN, e.g. 'targetgroup/name/id' or 'loadbalancer/app/name/id'.
+func arnResource(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	return parts[len(parts)-1]
+}
+
+func (d *Deployer) canaryQueries(ctx context.Context, target *DeployTarget, idPrefix string, period int32) ([]cwTypes.MetricDataQuery, error) {
+	targetGroup, err := d.client.DescribeALBTargetGroup(ctx, *target.TargetGroup.TargetGroupArn)
+	if err != nil {
+		return nil, err
+	}
+	if len(targetGroup.LoadBalancerArns) == 0 {
+		return nil, errors.Errorf("The '%s' target group is not associated with any load balancer.", target.Type)
+	}
+
+	dimensions := []cwTypes.Dimension{
+		{
+			Name:  aws.String("TargetGroup"),
+			Value: aws.String(arnResource(*target.TargetGroup.TargetGroupArn)),
+		},
+		{
+			Name:  aws.String("LoadBalancer"),
+			Value: aws.String(strings.TrimPrefix(arnResource(targetGroup.LoadBalancerArns[0]), "loadbalancer/")),
+		},
+	}
+	query := func(id string, metricName string, stat string) cwTypes.MetricDataQuery {
+		return cwTypes.MetricDataQuery{
+			Id:    aws.String(idPrefix + "_" + id),
+			Label: aws.String(metricName),
+			MetricStat: &cwTypes.MetricStat{
+				Metric: &cwTypes.Metric{
+					Namespace:  aws.String("AWS/ApplicationELB"),
+					MetricName: aws.String(metricName),
+					Dimensions: dimensions,
+				},
+				Period: aws.Int32(period),
+				Stat:   aws.String(stat),
+			},
+		}
+	}
+
+	return []cwTypes.MetricDataQuery{
+		query("requests", "RequestCount", "Sum"),
+		query("errors", "HTTPCode_Target_5XX_Count", "Sum"),
+		query("latency", "TargetResponseTime", "Average"),
+	}, nil
+}
+
+// AnalyzeCanary Compare the ALB metrics of the new target with the old one between startTime and endTime,
+// and show the report. Returns CanaryError if the verdict is fail.
+func (d *Deployer) AnalyzeCanary(ctx context.Context, next *DeployTarget, prev *DeployTarget, startTime time.Time, endTime time.Time) (*CanaryReport, error) {
+	// One period covers the whole window, rounded up to a minute.
+	period := int32(math.Ceil(endTime.Sub(startTime).Minutes())) * 60
+	if period < 60 {
+		period = 60
+	}
+
+	report := &CanaryReport{
+		StartTime: startTime,
+		EndTime:   endTime,
+		location:  d.config.TimeZone.CurrentLocation(),
+		Metrics: []CanaryMetrics{
+			{TargetType: string(next.Type), Role: "new"},
+			{TargetType: string(prev.Type), Role: "old"},
+		},
+	}
+
+	var queries []cwTypes.MetricDataQuery
+	owners := map[string]*CanaryMetrics{}
+	for i, target := range []*DeployTarget{next, prev} {
+		targetQueries, err := d.canaryQueries(ctx, target, fmt.Sprintf("t%d", i), period)
+		if err != nil {
+			return nil, err
+		}
+		for _, query := range targetQueries {
+			owners[*query.Id] = &report.Metrics[i]
+		}
+		queries = append(queries, targetQueries...)
+	}
+
+	results, err := d.client.GetCloudWatchMetricData(ctx, queries, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// The response time is the average of each period, so the requests of the period are needed to average them.
+	requests := map[*CanaryMetrics]map[time.Time]float64{}
+	var responseTimes []cwTypes.MetricDataResult
+	for _, result := range mergeMetricDataResults(results) {
+		metrics, ok := owners[*result.Id]
+		if !ok {
+			return nil, errors.Errorf("Unexpected metric data. id:%s", *result.Id)
+		}
+		var sum float64
+		for _, value := range result.Values {
+			sum += value
+		}
+		switch *result.Label {
+		case "RequestCount":
+			metrics.RequestCount = sum
+			requests[metrics] = map[time.Time]float64{}
+			for i, timestamp := range result.Timestamps {
+				if i < len(result.Values) {
+					requests[metrics][timestamp] = result.Values[i]
+				}
+			}
+		case "HTTPCode_Target_5XX_Count":
+			metrics.Target5XXCount = sum
+		case "TargetResponseTime":
+			responseTimes = append(responseTimes, result)
+		}
+	}
+	for _, result := range responseTimes {
+		metrics := owners[*result.Id]
+		metrics.ResponseTime = weightedAverage(result, requests[metrics])
+	}
+
+	report.judge(d.config.CanaryAnalysis)
+	if err := report.AsTable(os.Stdout); err != nil {
+		return nil, err
+	}
+
+	if report.Verdict == CanaryVerdictFail {
+		return report, errors.Wrapf(CanaryError, "Canary analysis failed. %s", report.Reason)
+	}
+	if report.Verdict == CanaryVerdictInconclusive {
+		if d.config.CanaryAnalysis.FailIfInconclusive {
+			return report, errors.Wrapf(CanaryError, "Canary analysis is inconclusive. %s", report.Reason)
+		}
+		d.logger.Warn(fmt.Sprintf("Canary analysis is inconclusive, so continue. %s", report.Reason), nil)
+	}
+
+	return report, nil
+}
+
+// mergeMetricDataResults The datapoints of a query can be split into the results of several pages,
+// so join them into one result per Id in the order of the first appearance.
+func mergeMetricDataResults(results []cwTypes.MetricDataResult) []cwTypes.MetricDataResult {
+	var merged []cwTypes.MetricDataResult
+	indexes := map[string]int{}
+	for _, result := range results {
+		index, ok := indexes[*result.Id]
+		if !ok {
+			indexes[*result.Id] = len(merged)
+			result.Values = slices.Clone(result.Values)
+			result.Timestamps = slices.Clone(result.Timestamps)
+			merged = append(merged, result)
+			continue
+		}
+		merged[index].Values = append(merged[index].Values, result.Values...)
+		merged[index].Timestamps = append(merged[index].Timestamps, result.Timestamps...)
+	}
+	return merged
+}
+
+// weightedAverage Average of the per-period averages weighted by the requests of the same period.
+// The periods without requests are ignored, and it falls back to the simple average if no period has requests.
+func weightedAverage(result cwTypes.MetricDataResult, requests map[time.Time]float64) float64 {
+	var sum, weights float64
+	for i, value := range result.Values {
+		if i < len(result.Timestamps) {
+			weight := requests[result.Timestamps[i]]
+			sum += value * weight
+			weights += weight
+		}
+	}
+	if weights > 0 {
+		return sum / weights
+	}
+
+	if len(result.Values) == 0 {
+		return 0
+	}
+	sum = 0
+	for _, value := range result.Values {
+		sum += value
+	}
+	return sum / float64(len(result.Values))
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/pkg/errors"
+)
+
+// interrupted Whether the command has been cancelled by a signal or has timed out.
+func interrupted(ctx context.Context) bool {
+	return ctx.Err() != nil
+}
+
+// compensationContext Returns a context that is not cancelled together with ctx, so that the compensation can still call AWS.
+func (d *Deployer) compensationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), time.Duration(d.config.Cancellation.TimeoutSeconds)*time.Second)
+}
+
+// compensateSwap Restore the weights at the start of the interrupted swap.
+func (d *Deployer) compensateSwap(ctx context.Context, blue *DeployTarget, green *DeployTarget, reason error) error {
+	ctx, cancel := d.compensationContext(ctx)
+	defer cancel()
+
+	d.logger.Error("Traffic swap interrupted. Restore the previous traffic.", reason)
+	d.logger.Info(fmt.Sprintf("Traffic update to blue->%d%%, green->%d%%.",
+		*blue.TargetGroup.Weight,
+		*green.TargetGroup.Weight))
+	if err := d.UpdateTraffic(ctx, *blue.TargetGroup.Weight, *green.TargetGroup.Weight); err != nil {
+		return errors.WithMessage(err, "Compensation failed.")
+	}
+
+	return errors.Wrap(CancellationError, reason.Error())
+}
+
+// compensateDeploy Bring the interrupted deploy to a defined state and show what it was left in.
+// The traffic has already been restored by the swap. If Cancellation.ScaleDownIdle is set and the traffic has not been swapped,
+// the idle target is also scaled down and the checkpoint is deleted. Otherwise, the checkpoint is kept for 'ec2 deploy --resume'.
+func (d *Deployer) compensateDeploy(ctx context.Context, checkpoint *Checkpoint, reason error) error {
+	ctx, cancel := d.compensationContext(ctx)
+	defer cancel()
+
+	d.logger.Error(fmt.Sprintf("The deployment was interrupted after the '%s' phase.", checkpoint.Phase), reason)
+
+	info := checkpoint.Info
+	scaledDown := false
+	if d.config.Cancellation.ScaleDownIdle && !checkpoint.Done(PhaseSwap) {
+		d.logger.Info(fmt.Sprintf("Scale down the idle '%s' target.", info.IdlingTarget.Type))
+		err := d.UpdateAutoScalingGroup(ctx,
+			*info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName,
+			aws.Int32(0),
+			aws.Int32(0),
+			nil)
+		if err != nil {
+			d.logger.Error("Failed to scale down the idle target.", err)
+		} else {
+			scaledDown = true
+		}
+	}
+
+	d.logger.Info("The state left by the interrupted deployment:")
+	if err := d.ShowStatus(ctx, "table"); err != nil {
+		d.logger.Warn("Failed to get the current status. Check it with the 'ec2 status' command.", err)
+	}
+	if scaledDown {
+		d.deleteCheckpoint(ctx)
+		d.logger.Info("The traffic has not been swapped and the idle target is scaling down. Start over with 'ec2 deploy'.")
+	} else {
+		d.logger.Warn(fmt.Sprintf(
+			"The checkpoint remains at the '%s' phase. Continue it with 'ec2 deploy --resume', or restore the original state with 'ec2 abort'.",
+			checkpoint.Phase), nil)
+	}
+
+	return errors.Wrap(CancellationError, reason.Error())
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+var ConfigCheckError = errors.New("ConfigCheckError")
+
+type ConfigCheck struct {
+	Name     string `json:"check"`
+	Resource string `json:"resource"`
+	Passed   bool   `json:"passed"`
+	Message  string `json:"message,omitempty"`
+}
+
+type ConfigCheckOutput struct {
+	Environment string        `json:"environment,omitempty"`
+	Checks      []ConfigCheck `json:"checks"`
+}
+
+// Failures Number of the checks that failed.
+func (o *ConfigCheckOutput) Failures() int {
+	return len(Filter(o.Checks, func(c *ConfigCheck) bool { return !c.Passed }))
+}
+
+func (o *ConfigCheckOutput) AsJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(o)
+}
+
+func (o *ConfigCheckOutput) AsTable(w io.Writer) error {
+	if o.Environment != "" {
+		fmt.Fprintf(w, "Environment: %s\n", o.Environment)
+	}
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"result", "check", "resource", "message"})
+	for _, check := range o.Checks {
+		result := "pass"
+		if !check.Passed {
+			result = "fail"
+		}
+		table.Append([]string{result, check.Name, check.Resource, check.Message})
+	}
+	table.Render()
+	fmt.Fprintf(w, "%d passed, %d failed.\n", len(o.Checks)-o.Failures(), o.Failures())
+	return nil
+}
+
+func (o *ConfigCheckOutput) add(name string, resource string, err error) {
+	check := ConfigCheck{Name: name, Resource: resource, Passed: err == nil}
+	if err != nil {
+		check.Message = checkMessage(err)
+	}
+	o.Checks = append(o.Checks, check)
+}
+
+// checkMessage The API error without the request details, e.g. 'TargetGroupNotFound: One or more target groups not found'.
+func checkMessage(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("%s: %s", apiErr.ErrorCode(), apiErr.ErrorMessage())
+	}
+	return err.Error()
+}
+
+// ConfigChecker Confirms that the AWS resources referenced by the config exist and fit together.
+type ConfigChecker struct {
+	config *Config
+	client AwsClient
+	logger Logger
+}
+
+func NewConfigChecker(deployConfig *Config, awsClient AwsClient, logger Logger) *ConfigChecker {
+	return &ConfigChecker{
+		config: deployConfig,
+		client: awsClient,
+		logger: logger,
+	}
+}
+
+// Check Run every check. A failed check does not stop the others, so all the mistakes are reported at once.
+func (c *ConfigChecker) Check(ctx context.Context) *ConfigCheckOutput {
+	output := &ConfigCheckOutput{Environment: c.config.Environment}
+
+	output.add("bundle bucket exists", c.config.BundleBucket, c.client.HeadS3Bucket(ctx, c.config.BundleBucket))
+
+	rule, err := c.client.GetALBListenerRule(ctx, c.config.ListenerRuleArn)
+	var forwardAction *albTypes.ForwardActionConfig
+	if err == nil {
+		for _, action := range rule.Actions {
+			if action.Type == albTypes.ActionTypeEnumForward && action.ForwardConfig != nil {
+				forwardAction = action.ForwardConfig
+			}
+		}
+		if forwardAction == nil {
+			err = errors.New("The listener rule has no forward action.")
+		}
+	}
+	output.add("listener rule exists with forward action", c.config.ListenerRuleArn, err)
+
+	for _, targetType := range []TargetType{BlueTargetType, GreenTargetType} {
+		target := c.config.Target.Blue
+		if targetType == GreenTargetType {
+			target = c.config.Target.Green
+		}
+
+		_, err := c.client.DescribeALBTargetGroup(ctx, target.TargetGroupArn)
+		output.add(fmt.Sprintf("%s target group exists", targetType), target.TargetGroupArn, err)
+
+		err = nil
+		if forwardAction == nil {
+			err = errors.New("The listener rule has no forward action.")
+		} else if !slices.ContainsFunc(forwardAction.TargetGroups, func(tg albTypes.TargetGroupTuple) bool {
+			return tg.TargetGroupArn != nil && *tg.TargetGroupArn == target.TargetGroupArn
+		}) {
+			err = errors.New("The forward action of the listener rule does not contain the target group.")
+		}
+		output.add(fmt.Sprintf("%s target group in listener rule", targetType), target.TargetGroupArn, err)
+
+		autoScalingGroup, err := c.client.DescribeAutoScalingGroup(ctx, target.AutoScalingGroupName)
+		output.add(fmt.Sprintf("%s auto scaling group exists", targetType), target.AutoScalingGroupName, err)
+
+		if err == nil && !slices.Contains(autoScalingGroup.TargetGroupARNs, target.TargetGroupArn) {
+			err = errors.Errorf("The auto scaling group is attached to %v.", autoScalingGroup.TargetGroupARNs)
+		}
+		output.add(fmt.Sprintf("%s target group attached to auto scaling group", targetType), target.AutoScalingGroupName, err)
+	}
+
+	return output
+}
+
+// Validate Show the result of every check. Returns ConfigCheckError if any check failed.
+func (c *ConfigChecker) Validate(ctx context.Context, outputFormat string) error {
+	output := c.Check(ctx)
+
+	var err error
+	if outputFormat == "json" {
+		err = output.AsJSON(os.Stdout)
+	} else {
+		err = output.AsTable(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if failures := output.Failures(); failures > 0 {
+		return errors.Wrapf(ConfigCheckError, "%d of %d config checks failed.", failures, len(output.Checks))
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+)
+
+const CheckpointKey string = "deployman.checkpoint"
+
+// DeployPhase Phase of the deploy. The checkpoint records the last completed one.
+type DeployPhase string
+
+const (
+	PhaseStarted      DeployPhase = "started"
+	PhaseCleanup      DeployPhase = "cleanup"
+	PhaseScaleUp      DeployPhase = "scale-up"
+	PhaseHealthCheck  DeployPhase = "health-check"
+	PhaseSwap         DeployPhase = "swap"
+	PhaseFinalCleanup DeployPhase = "final-cleanup"
+)
+
+var deployPhases = []DeployPhase{PhaseStarted, PhaseCleanup, PhaseScaleUp, PhaseHealthCheck, PhaseSwap, PhaseFinalCleanup}
+
+// Checkpoint State of an unfinished deploy stored in the bundle bucket.
+// Info holds the original capacities and weights at the start of the deploy.
+type Checkpoint struct {
+	Operation           string       `json:"operation"`
+	Phase               DeployPhase  `json:"phase"`
+	Swap                bool         `json:"swap"`
+	CleanupBeforeDeploy bool         `json:"cleanupBeforeDeploy"`
+	CleanupAfterDeploy  bool         `json:"cleanupAfterDeploy"`
+	Steps               TrafficSteps `json:"steps"`
+	Info                *DeployInfo  `json:"info"`
+	Actor               string       `json:"actor"`
+	Host                string       `json:"host"`
+	StartedAt           time.Time    `json:"startedAt"`
+	UpdatedAt           time.Time    `json:"updatedAt"`
+}
+
+func newCheckpoint(operation string, info *DeployInfo, swap bool, cleanupBeforeDeploy bool, cleanupAfterDeploy bool, steps TrafficSteps) *Checkpoint {
+	now := time.Now()
+	return &Checkpoint{
+		Operation:           operation,
+		Phase:               PhaseStarted,
+		Swap:                swap,
+		CleanupBeforeDeploy: cleanupBeforeDeploy,
+		CleanupAfterDeploy:  cleanupAfterDeploy,
+		Steps:               steps,
+		Info:                info,
+		Actor:               currentOwner(),
+		Host:                currentHost(),
+		StartedAt:           now,
+		UpdatedAt:           now,
+	}
+}
+
+// Done Whether the phase has already been completed.
+func (c *Checkpoint) Done(phase DeployPhase) bool {
+	return slices.Index(deployPhases, c.Phase) >= slices.Index(deployPhases, phase)
+}
+
+func (c *Checkpoint) String() string {
+	return fmt.Sprintf("operation:%s, phase:%s, actor:%s, host:%s, started:%s",
+		c.Operation, c.Phase, c.Actor, c.Host, c.StartedAt.Format(time.RFC3339))
+}
+
+// GetCheckpoint Returns the checkpoint of the unfinished deploy, or nil if there is none.
+func (d *Deployer) GetCheckpoint(ctx context.Context) (*Checkpoint, error) {
+	output, err := d.client.GetS3BucketObject(ctx, d.config.BundleBucket, CheckpointKey)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(output.Body); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(buf.Bytes(), checkpoint); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return checkpoint, nil
+}
+
+// saveCheckpoint Record the phase as completed.
+func (d *Deployer) saveCheckpoint(ctx context.Context, checkpoint *Checkpoint, phase DeployPhase) error {
+	checkpoint.Phase = phase
+	checkpoint.UpdatedAt = time.Now()
+
+	raw, err := json.Marshal(checkpoint)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := d.client.PutS3BucketObjectAsTextFile(ctx, d.config.BundleBucket, CheckpointKey, string(raw)); err != nil {
+		return err
+	}
+	d.logger.Debug(fmt.Sprintf("Checkpoint saved. %s", checkpoint))
+
+	return nil
+}
+
+func (d *Deployer) deleteCheckpoint(ctx context.Context) {
+	if err := d.client.DeleteS3BucketObject(ctx, d.config.BundleBucket, CheckpointKey); err != nil {
+		d.logger.Warn("Failed to delete the checkpoint. Delete it with the 'ec2 abort' command.", err)
+	}
+}
+
+// ResumeDeploy Continue the unfinished deploy from the phase after the last completed one.
+func (d *Deployer) ResumeDeploy(ctx context.Context) (err error) {
+	checkpoint, err := d.GetCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		return errors.New("There is no unfinished deployment to resume.")
+	}
+
+	// The killed process usually leaves its lock, so take it over if it was acquired by the same actor and host for the checkpoint.
+	err = d.locker.TakeOver(ctx, func(current *Lock) bool {
+		return current.Owner == checkpoint.Actor && current.Host == checkpoint.Host && !current.AcquiredAt.After(checkpoint.StartedAt)
+	})
+	if err != nil {
+		if errors.Is(err, LockedError) {
+			return errors.WithMessage(err, "If the lock was left by the interrupted deployment, release it with 'lock release --force' and resume again.")
+		}
+		return err
+	}
+	defer func() {
+		if err := d.locker.Release(context.WithoutCancel(ctx)); err != nil {
+			d.logger.Warn("Failed to release the lock. Check it with the 'lock status' command.", err)
+		}
+	}()
+
+	finish, err := d.begin(ctx, checkpoint.Operation)
+	if err != nil {
+		return err
+	}
+	defer func() { finish(err) }()
+
+	d.logger.Info(fmt.Sprintf("Resume the deployment. %s", checkpoint))
+	if checkpoint.Swap && checkpoint.Done(PhaseHealthCheck) && !checkpoint.Done(PhaseSwap) {
+		// The swap may have stopped halfway, so start it over from the original weights.
+		if err := d.restoreTraffic(ctx, checkpoint.Info); err != nil {
+			return err
+		}
+	}
+
+	return d.runDeploy(ctx, checkpoint)
+}
+
+// AbortDeploy Restore the original capacities and weights recorded in the checkpoint of the unfinished deploy.
+func (d *Deployer) AbortDeploy(ctx context.Context) (err error) {
+	checkpoint, err := d.GetCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		d.logger.Info("There is no unfinished deployment.")
+		return nil
+	}
+
+	finish, err := d.begin(ctx, "abort")
+	if err != nil {
+		return err
+	}
+	defer func() { finish(err) }()
+
+	d.logger.Info(fmt.Sprintf("Restore the original state. %s", checkpoint))
+	info := checkpoint.Info
+	if err := d.restoreTraffic(ctx, info); err != nil {
+		return err
+	}
+	if err := d.restoreCapacity(ctx, info.RunningTarget); err != nil {
+		return err
+	}
+	if err := d.restoreCapacity(ctx, info.IdlingTarget); err != nil {
+		return err
+	}
+	d.deleteCheckpoint(ctx)
+
+	return d.ShowStatus(ctx, "table")
+}
+
+// restoreTraffic Restore the weights at the start of the deploy.
+func (d *Deployer) restoreTraffic(ctx context.Context, info *DeployInfo) error {
+	blue, green := info.IdlingTarget, info.RunningTarget
+	if blue.Type != BlueTargetType {
+		blue, green = green, blue
+	}
+	d.logger.Info(fmt.Sprintf("Traffic update to blue->%d%%, green->%d%%.", *blue.TargetGroup.Weight, *green.TargetGroup.Weight))
+	return d.UpdateTraffic(ctx, *blue.TargetGroup.Weight, *green.TargetGroup.Weight)
+}
+
+// restoreCapacity Restore the capacity of the target at the start of the deploy.
+func (d *Deployer) restoreCapacity(ctx context.Context, target *DeployTarget) error {
+	autoScalingGroup := target.AutoScalingGroup
+	d.logger.Info(fmt.Sprintf("Restore the capacity of '%s'. desired:%d, min:%d, max:%d",
+		*autoScalingGroup.AutoScalingGroupName,
+		*autoScalingGroup.DesiredCapacity,
+		*autoScalingGroup.MinSize,
+		*autoScalingGroup.MaxSize))
+	return d.UpdateAutoScalingGroup(ctx,
+		*autoScalingGroup.AutoScalingGroupName,
+		autoScalingGroup.DesiredCapacity,
+		autoScalingGroup.MinSize,
+		autoScalingGroup.MaxSize)
+}
@@ -3,7 +3,12 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"maps"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -12,11 +17,25 @@ import (
 )
 
 type Config struct {
-	BundleBucket    string       `json:"bundleBucket" validate:"required"`
-	ListenerRuleArn string       `json:"listenerRuleArn" validate:"required"`
-	Target          *TargetSet   `json:"target" validate:"required"`
-	RetryPolicy     *RetryPolicy `json:"retryPolicy" validate:"required"`
-	TimeZone        *TimeZone    `json:"timeZone" validate:"required"`
+	BundleBucket        string          `json:"bundleBucket" validate:"required"`
+	ListenerRuleArn     string          `json:"listenerRuleArn" validate:"required"`
+	Target              *TargetSet      `json:"target" validate:"required"`
+	RetryPolicy         *RetryPolicy    `json:"retryPolicy" validate:"required"`
+	HealthWatch         *HealthWatch    `json:"healthWatch" validate:"required"`
+	Hooks               *Hooks          `json:"hooks" validate:"required"`
+	SmokeTest           *SmokeTest      `json:"smokeTest" validate:"required"`
+	CanaryAnalysis      *CanaryAnalysis `json:"canaryAnalysis" validate:"required"`
+	Cancellation        *Cancellation   `json:"cancellation" validate:"required"`
+	TimeZone            *TimeZone       `json:"timeZone" validate:"required"`
+	EndpointUrl         string          `json:"endpointUrl" validate:"omitempty,url"`
+	S3UsePathStyle      bool            `json:"s3UsePathStyle"`
+	Region              string          `json:"region"`
+	RoleArn             string          `json:"roleArn" validate:"omitempty,startswith=arn:"`
+	ExternalId          string          `json:"externalId" validate:"excluded_without=RoleArn"`
+	SessionName         string          `json:"sessionName" validate:"min=2,max=64"`
+	RequireSignature    bool            `json:"requireSignature"`
+	SignaturePublicKeys []string        `json:"signaturePublicKeys" validate:"required_if=RequireSignature true"`
+	Environment         string          `json:"-"`
 }
 
 type TargetSet struct {
@@ -26,12 +45,144 @@ type TargetSet struct {
 
 type Target struct {
 	AutoScalingGroupName string `json:"autoScalingGroupName" validate:"required"`
-	TargetGroupArn       string `json:"TargetGroupArn" validate:"required"`
+	TargetGroupArn       string `json:"targetGroupArn" validate:"required"`
 }
 
+// RetryPolicy Retry strategies per operation. HealthCheck and Cleanup default to the fixed interval of MaxLimit and IntervalSeconds.
 type RetryPolicy struct {
-	MaxLimit        int `json:"maxLimit"`
-	IntervalSeconds int `json:"intervalSeconds"`
+	MaxLimit        int            `json:"maxLimit"`
+	IntervalSeconds int            `json:"intervalSeconds"`
+	HealthCheck     *RetryStrategy `json:"healthCheck"`
+	Cleanup         *RetryStrategy `json:"cleanup"`
+	Throttling      *RetryStrategy `json:"throttling" validate:"required"`
+}
+
+// RetryStrategy How to wait between attempts. The zero fields are filled with the defaults of the type.
+//   - fixed: IntervalSeconds up to MaxLimit times.
+//   - exponential: IntervalSeconds multiplied by Multiplier on every attempt up to MaxIntervalSeconds, MaxLimit times.
+//   - jitter: A random duration up to the exponential interval, MaxLimit times.
+//   - deadline: IntervalSeconds until TimeoutSeconds has elapsed.
+type RetryStrategy struct {
+	Type               string  `json:"type" validate:"omitempty,oneof=fixed exponential jitter deadline"`
+	MaxLimit           int     `json:"maxLimit" validate:"min=0"`
+	IntervalSeconds    int     `json:"intervalSeconds" validate:"min=0"`
+	MaxIntervalSeconds int     `json:"maxIntervalSeconds" validate:"min=0"`
+	Multiplier         float64 `json:"multiplier" validate:"min=0"`
+	TimeoutSeconds     int     `json:"timeoutSeconds" validate:"min=0"`
+}
+
+// withDefaults Returns a copy of the strategy whose zero fields are filled with the defaults.
+func (s RetryStrategy) withDefaults(maxLimit int, intervalSeconds int) *RetryStrategy {
+	if s.Type == "" {
+		s.Type = RetryTypeFixed
+	}
+	if s.MaxLimit == 0 {
+		s.MaxLimit = maxLimit
+	}
+	if s.IntervalSeconds == 0 {
+		s.IntervalSeconds = intervalSeconds
+	}
+	if s.Multiplier == 0 {
+		s.Multiplier = 2
+	}
+	if s.MaxIntervalSeconds == 0 {
+		s.MaxIntervalSeconds = s.IntervalSeconds * 10
+	}
+	if s.TimeoutSeconds == 0 {
+		s.TimeoutSeconds = s.MaxLimit * s.IntervalSeconds
+	}
+	return &s
+}
+
+// HealthCheckStrategy Strategy for waiting until the new instances become healthy.
+func (p *RetryPolicy) HealthCheckStrategy() *RetryStrategy {
+	return p.strategy(p.HealthCheck)
+}
+
+// CleanupStrategy Strategy for waiting until the instances of the idle target are terminated.
+func (p *RetryPolicy) CleanupStrategy() *RetryStrategy {
+	return p.strategy(p.Cleanup)
+}
+
+// ThrottlingStrategy Strategy for calling the AWS API again that has been throttled.
+func (p *RetryPolicy) ThrottlingStrategy() *RetryStrategy {
+	return p.Throttling.withDefaults(5, 1)
+}
+
+func newDefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxLimit:        120,
+		IntervalSeconds: 10,
+		Throttling: &RetryStrategy{
+			Type:               RetryTypeJitter,
+			MaxLimit:           5,
+			IntervalSeconds:    1,
+			MaxIntervalSeconds: 20,
+		},
+	}
+}
+
+func (p *RetryPolicy) strategy(strategy *RetryStrategy) *RetryStrategy {
+	if strategy == nil {
+		strategy = &RetryStrategy{Type: RetryTypeFixed}
+	}
+	return strategy.withDefaults(p.MaxLimit, p.IntervalSeconds)
+}
+
+// HealthWatch Policy for watching the new target while traffic is being shifted.
+// If the healthy count drops below MinHealthyPercent of the desired capacity, or any of AlarmNames goes into ALARM, the traffic is rolled back.
+type HealthWatch struct {
+	MinHealthyPercent int      `json:"minHealthyPercent" validate:"min=0,max=100"`
+	IntervalSeconds   int      `json:"intervalSeconds" validate:"min=1"`
+	AlarmNames        []string `json:"alarmNames" validate:"max=100,dive,required"`
+}
+
+// Hooks Commands run by 'sh -c' at fixed points of the deploy. Each point runs only when its phase runs.
+// A command that exits with non-zero aborts the deploy and rolls it back.
+type Hooks struct {
+	BeforeCleanup    []string `json:"beforeCleanup"`
+	AfterScaleUp     []string `json:"afterScaleUp"`
+	AfterHealthCheck []string `json:"afterHealthCheck"`
+	BeforeSwap       []string `json:"beforeSwap"`
+	AfterSwap        []string `json:"afterSwap"`
+	AfterCleanup     []string `json:"afterCleanup"`
+	TimeoutSeconds   int      `json:"timeoutSeconds" validate:"min=1"`
+}
+
+// SmokeTest HTTP requests sent to every healthy target of the new target before the traffic is swapped.
+// Any failure rolls back the deploy in the same way as a health check timeout.
+type SmokeTest struct {
+	Scheme         string             `json:"scheme" validate:"oneof=http https"`
+	Port           int32              `json:"port" validate:"min=0,max=65535"`
+	TimeoutSeconds int                `json:"timeoutSeconds" validate:"min=1"`
+	Requests       []SmokeTestRequest `json:"requests" validate:"dive"`
+}
+
+type SmokeTestRequest struct {
+	Path           string            `json:"path" validate:"required,startswith=/"`
+	Method         string            `json:"method"`
+	Headers        map[string]string `json:"headers"`
+	ExpectedStatus int               `json:"expectedStatus"`
+	BodyPattern    string            `json:"bodyPattern" validate:"omitempty,regexp"`
+}
+
+// CanaryAnalysis Thresholds for comparing the ALB metrics of the new target with the old one at the end of each bake time.
+// If the new target is worse than the thresholds, the traffic is rolled back.
+// The ALB metrics reach CloudWatch a few minutes late, so the analysis waits MetricDelaySeconds after the bake time.
+type CanaryAnalysis struct {
+	Enabled              bool    `json:"enabled"`
+	MinRequestCount      int     `json:"minRequestCount" validate:"min=0"`
+	Max5XXRateDiff       float64 `json:"max5xxRateDiff" validate:"min=0"`
+	MaxResponseTimeRatio float64 `json:"maxResponseTimeRatio" validate:"gt=0"`
+	MetricDelaySeconds   int     `json:"metricDelaySeconds" validate:"min=0"`
+	FailIfInconclusive   bool    `json:"failIfInconclusive"`
+}
+
+// Cancellation Compensation run when the command is interrupted by SIGINT/SIGTERM or the timeout.
+// The traffic being shifted is always restored. The idle target is scaled down only if ScaleDownIdle is set.
+type Cancellation struct {
+	ScaleDownIdle  bool `json:"scaleDownIdle"`
+	TimeoutSeconds int  `json:"timeoutSeconds" validate:"min=1"`
 }
 
 type TimeZone struct {
@@ -49,18 +200,38 @@ func (t *TimeZone) CurrentLocation() *time.Location {
 	return location
 }
 
-func NewConfig(ctx context.Context, awsClient AwsClient, filepath string) (*Config, error) {
-	config := &Config{
-		RetryPolicy: &RetryPolicy{
-			MaxLimit:        120,
-			IntervalSeconds: 10,
+func newDefaultConfig() *Config {
+	return &Config{
+		SessionName: "deployman",
+		RetryPolicy: newDefaultRetryPolicy(),
+		HealthWatch: &HealthWatch{
+			MinHealthyPercent: 100,
+			IntervalSeconds:   10,
+		},
+		Hooks: &Hooks{
+			TimeoutSeconds: 600,
+		},
+		SmokeTest: &SmokeTest{
+			Scheme:         "http",
+			TimeoutSeconds: 10,
+		},
+		CanaryAnalysis: &CanaryAnalysis{
+			MinRequestCount:      100,
+			Max5XXRateDiff:       1.0,
+			MaxResponseTimeRatio: 1.5,
+			MetricDelaySeconds:   180,
+		},
+		Cancellation: &Cancellation{
+			TimeoutSeconds: 120,
 		},
 		TimeZone: &TimeZone{
 			Location: "Asia/Tokyo",
 			Offset:   9 * 60 * 60,
 		},
 	}
+}
 
+func NewConfig(ctx context.Context, awsClient AwsClient, filepath string, env string) (*Config, error) {
 	var raw []byte
 	if strings.HasPrefix(filepath, "ssm:") {
 		ssmParameterName := strings.TrimPrefix(filepath, "ssm:")
@@ -77,14 +248,99 @@ func NewConfig(ctx context.Context, awsClient AwsClient, filepath string) (*Conf
 		raw = file
 	}
 
-	if err := json.Unmarshal(raw, &config); err != nil {
+	return parseConfig(raw, isYamlConfig(filepath, raw), env)
+}
+
+// parseConfig Decode the config and the environment onto the defaults, and validate it.
+func parseConfig(raw []byte, isYaml bool, env string) (*Config, error) {
+	raw, err := normalizeConfig(raw, isYaml, env)
+	if err != nil {
+		return nil, err
+	}
+
+	config := newDefaultConfig()
+	if err := json.Unmarshal(raw, config); err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	err := validator.New().Struct(config)
-	if err != nil {
+	file := &configFile{}
+	if err := json.Unmarshal(raw, file); err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if err := file.overlay(config, env); err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
+
+// configFile Environments of the config file. Each one overrides the shared values at the top level.
+type configFile struct {
+	Environments map[string]json.RawMessage `json:"environments"`
+}
+
+// overlay Decode the environment onto the shared values. Objects such as target, retryPolicy and timeZone
+// are merged field by field, and the other values including arrays are replaced.
+func (f *configFile) overlay(config *Config, env string) error {
+	names := slices.Sorted(maps.Keys(f.Environments))
+	if env == "" {
+		if len(names) > 0 {
+			return errors.Errorf("Select the environment with --env. Valid values are %s.", strings.Join(names, ", "))
+		}
+		return nil
+	}
+
+	raw, ok := f.Environments[env]
+	if !ok {
+		return errors.Errorf("The '%s' environment is not defined in the config. Valid values are %s.", env, strings.Join(names, ", "))
+	}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return errors.Wrapf(err, "Invalid config of the '%s' environment.", env)
+	}
+	config.Environment = env
+
+	return nil
+}
+
+// validateConfig Returns the error that names the environment and every field that failed, e.g. 'target.blue.autoScalingGroupName: required'.
+func validateConfig(config *Config) error {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	_ = validate.RegisterValidation("regexp", func(fl validator.FieldLevel) bool {
+		_, err := regexp.Compile(fl.Field().String())
+		return err == nil
+	})
+
+	err := validate.Struct(config)
+	if err == nil {
+		return nil
+	}
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return errors.WithStack(err)
+	}
+
+	fields := make([]string, len(validationErrors))
+	for i, fieldError := range validationErrors {
+		rule := fieldError.Tag()
+		if fieldError.Param() != "" {
+			rule += "=" + fieldError.Param()
+		}
+		_, field, _ := strings.Cut(fieldError.Namespace(), ".")
+		fields[i] = fmt.Sprintf("%s: %s", field, rule)
+	}
+	if config.Environment != "" {
+		return errors.Errorf("Invalid config of the '%s' environment. %s", config.Environment, strings.Join(fields, ", "))
+	}
+	return errors.Errorf("Invalid config. %s", strings.Join(fields, ", "))
+}
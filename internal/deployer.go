@@ -12,6 +12,7 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/olekukonko/tablewriter"
 	"github.com/pkg/errors"
@@ -22,25 +23,32 @@ const (
 	GreenTargetType TargetType = "green"
 )
 
-var CancellationError = errors.New("CancellationError")
+var (
+	CancellationError    = errors.New("CancellationError")
+	UnhealthyTargetError = errors.New("UnhealthyTargetError")
+	AlarmError           = errors.New("AlarmError")
+)
 
 type TargetType string
 
 type Deployer struct {
-	config *Config
-	client AwsClient
-	logger Logger
+	config  *Config
+	client  AwsClient
+	logger  Logger
+	locker  *Locker
+	history *History
+	record  *HistoryRecord
 }
 
 type DeployTarget struct {
-	Type             TargetType
-	TargetGroup      *albTypes.TargetGroupTuple
-	AutoScalingGroup *asgTypes.AutoScalingGroup
+	Type             TargetType                 `json:"type"`
+	TargetGroup      *albTypes.TargetGroupTuple `json:"targetGroup"`
+	AutoScalingGroup *asgTypes.AutoScalingGroup `json:"autoScalingGroup"`
 }
 
 type DeployInfo struct {
-	IdlingTarget  *DeployTarget
-	RunningTarget *DeployTarget
+	IdlingTarget  *DeployTarget `json:"idlingTarget"`
+	RunningTarget *DeployTarget `json:"runningTarget"`
 }
 
 type HealthInfo struct {
@@ -170,12 +178,58 @@ func (s *StatusOutput) AsTable(w io.Writer) error {
 
 func NewDeployer(deployConfig *Config, awsClient AwsClient, logger Logger) *Deployer {
 	return &Deployer{
-		config: deployConfig,
-		client: awsClient,
-		logger: logger,
+		config:  deployConfig,
+		client:  awsClient,
+		logger:  logger,
+		locker:  NewLocker(deployConfig, awsClient, logger),
+		history: NewHistory(deployConfig, awsClient, logger),
 	}
 }
 
+// begin Start a mutating operation. It takes the lock, and the outermost operation is recorded in the history when finished.
+func (d *Deployer) begin(ctx context.Context, operation string) (func(err error), error) {
+	if err := d.locker.Acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	var record *HistoryRecord
+	if d.record == nil {
+		record = newHistoryRecord(operation)
+		before, err := d.getTargetStatuses(ctx)
+		if err != nil {
+			d.logger.Warn("Failed to get the status before the operation. It will not be recorded in the history.", err)
+		}
+		record.Before = before
+		d.record = record
+	}
+
+	return func(err error) {
+		// Record and release even if the command has been cancelled.
+		ctx := context.WithoutCancel(ctx)
+		if record != nil {
+			d.record = nil
+			record.Finish(err)
+			after, err := d.getTargetStatuses(ctx)
+			if err != nil {
+				d.logger.Warn("Failed to get the status after the operation. It will not be recorded in the history.", err)
+			}
+			record.After = after
+			bundles, err := d.history.GetActiveBundles(ctx)
+			if err != nil {
+				d.logger.Warn("Failed to get the active bundles. It will not be recorded in the history.", err)
+			}
+			record.ActiveBundles = bundles
+			if err := d.history.Append(ctx, record); err != nil {
+				d.logger.Warn("Failed to record the history.", err)
+			}
+		}
+
+		if err := d.locker.Release(ctx); err != nil {
+			d.logger.Warn("Failed to release the lock. Check it with the 'lock status' command.", err)
+		}
+	}, nil
+}
+
 func (d *Deployer) getHealthInfo(ctx context.Context, targetGroupArn string) (*HealthInfo, error) {
 	health, err := d.client.DescribeALBTargetHealth(ctx, targetGroupArn)
 	if err != nil {
@@ -272,19 +326,19 @@ func (d *Deployer) GetDeployInfo(ctx context.Context) (*DeployInfo, error) {
 	}
 }
 
-func (d *Deployer) ShowStatus(ctx context.Context, outputFormat string) error {
+func (d *Deployer) getTargetStatuses(ctx context.Context) ([]TargetStatus, error) {
 	//DeployTarget
 	rule, err := d.client.GetALBListenerRule(ctx, d.config.ListenerRuleArn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	blueTarget, err := d.GetDeployTarget(ctx, rule, BlueTargetType)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	greenTarget, err := d.GetDeployTarget(ctx, rule, GreenTargetType)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//TargetGroupName
@@ -297,21 +351,21 @@ func (d *Deployer) ShowStatus(ctx context.Context, outputFormat string) error {
 	}
 	blueTGName, err := getTargetGroupName(d.config.Target.Blue.TargetGroupArn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	greenTGName, err := getTargetGroupName(d.config.Target.Green.TargetGroupArn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//HealthInfo
 	blueHealth, err := d.getHealthInfo(ctx, d.config.Target.Blue.TargetGroupArn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	greenHealth, err := d.getHealthInfo(ctx, d.config.Target.Green.TargetGroupArn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	toStatus := func(target *DeployTarget, targetGroupName string, health *HealthInfo) TargetStatus {
@@ -331,11 +385,20 @@ func (d *Deployer) ShowStatus(ctx context.Context, outputFormat string) error {
 		}
 	}
 
+	return []TargetStatus{
+		toStatus(blueTarget, blueTGName, blueHealth),
+		toStatus(greenTarget, greenTGName, greenHealth),
+	}, nil
+}
+
+func (d *Deployer) ShowStatus(ctx context.Context, outputFormat string) error {
+	targets, err := d.getTargetStatuses(ctx)
+	if err != nil {
+		return err
+	}
+
 	output := &StatusOutput{
-		targets: []TargetStatus{
-			toStatus(blueTarget, blueTGName, blueHealth),
-			toStatus(greenTarget, greenTGName, greenHealth),
-		},
+		targets: targets,
 	}
 
 	if outputFormat == "json" {
@@ -348,14 +411,68 @@ func (d *Deployer) Deploy(
 	ctx context.Context, swap bool,
 	cleanupBeforeDeploy bool,
 	cleanupAfterDeploy bool,
-	swapDuration *time.Duration) error {
+	steps TrafficSteps) (err error) {
+
+	operation := "deploy"
+	if !cleanupBeforeDeploy {
+		operation = "rollback"
+	}
+	finish, err := d.begin(ctx, operation)
+	if err != nil {
+		return err
+	}
+	defer func() { finish(err) }()
+
+	unfinished, err := d.GetCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if unfinished != nil {
+		return errors.Errorf(
+			"An unfinished deployment exists. Continue it with 'ec2 deploy --resume', or restore the original state with 'ec2 abort'. %s",
+			unfinished)
+	}
 
 	info, err := d.GetDeployInfo(ctx)
 	if err != nil {
 		return err
 	}
 
-	if cleanupBeforeDeploy {
+	checkpoint := newCheckpoint(operation, info, swap, cleanupBeforeDeploy, cleanupAfterDeploy, steps)
+	if err := d.saveCheckpoint(ctx, checkpoint, PhaseStarted); err != nil {
+		return err
+	}
+
+	return d.runDeploy(ctx, checkpoint)
+}
+
+// runDeploy Run the phases after the last completed one of the checkpoint. The checkpoint is saved after each phase,
+// and deleted when the deploy has finished or has been rolled back.
+func (d *Deployer) runDeploy(ctx context.Context, checkpoint *Checkpoint) error {
+	err := d.runDeployPhases(ctx, checkpoint)
+	if err != nil && interrupted(ctx) {
+		return d.compensateDeploy(ctx, checkpoint, err)
+	}
+	if err == nil || errors.Is(err, CancellationError) {
+		d.deleteCheckpoint(ctx)
+		return err
+	}
+
+	d.logger.Warn(fmt.Sprintf(
+		"The deployment stopped after the '%s' phase. Continue it with 'ec2 deploy --resume', or restore the original state with 'ec2 abort'.",
+		checkpoint.Phase), nil)
+	return err
+}
+
+func (d *Deployer) runDeployPhases(ctx context.Context, checkpoint *Checkpoint) error {
+	info := checkpoint.Info
+
+	if checkpoint.CleanupBeforeDeploy && !checkpoint.Done(PhaseCleanup) {
+		if err := d.runHooks(ctx, HookBeforeCleanup, info); err != nil {
+			d.logger.Error("Hook failed. The deploy is aborted before any changes.", nil)
+			return errors.Wrap(CancellationError, err.Error())
+		}
+
 		d.logger.Info(fmt.Sprintf("Start cleanup on idle '%s' target.", string(info.IdlingTarget.Type)))
 
 		err := d.CleanupAutoScalingGroup(ctx, *info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName)
@@ -363,45 +480,80 @@ func (d *Deployer) Deploy(
 			return err
 		}
 		d.logger.Info("Cleanup completed.")
+		if err := d.saveCheckpoint(ctx, checkpoint, PhaseCleanup); err != nil {
+			return err
+		}
 	}
 
-	d.logger.Info(fmt.Sprintf(
-		"Start updating AutoScalingGruop of the '%s' target. Prepare instances of the same capacity as the '%s' target.",
-		info.IdlingTarget.Type,
-		info.RunningTarget.Type))
-	err = d.UpdateAutoScalingGroup(ctx,
-		*info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName,
-		info.RunningTarget.AutoScalingGroup.DesiredCapacity,
-		info.RunningTarget.AutoScalingGroup.MinSize,
-		info.RunningTarget.AutoScalingGroup.MaxSize)
-	if err != nil {
-		return err
+	if !checkpoint.Done(PhaseScaleUp) {
+		d.logger.Info(fmt.Sprintf(
+			"Start updating AutoScalingGruop of the '%s' target. Prepare instances of the same capacity as the '%s' target.",
+			info.IdlingTarget.Type,
+			info.RunningTarget.Type))
+		err := d.UpdateAutoScalingGroup(ctx,
+			*info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName,
+			info.RunningTarget.AutoScalingGroup.DesiredCapacity,
+			info.RunningTarget.AutoScalingGroup.MinSize,
+			info.RunningTarget.AutoScalingGroup.MaxSize)
+		if err != nil {
+			return err
+		}
+		d.logger.Info("AutoScalingGroup has been updated.")
+		if err := d.runHooks(ctx, HookAfterScaleUp, info); err != nil {
+			return d.rollbackDeploy(ctx, info, false, err)
+		}
+		if err := d.saveCheckpoint(ctx, checkpoint, PhaseScaleUp); err != nil {
+			return err
+		}
 	}
-	d.logger.Info("AutoScalingGroup has been updated.")
 
-	d.logger.Info(fmt.Sprintf("Start '%s' health check.", info.IdlingTarget.Type))
-	err = d.HealthCheck(ctx,
-		*info.IdlingTarget.TargetGroup.TargetGroupArn,
-		*info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName)
-	if err != nil {
-		if errors.Is(err, RetryTimeout) {
-			d.logger.Error("Health check timed out. Initiating a rollback as the process cannot continue.", nil)
-			if err := d.CleanupAutoScalingGroup(ctx, *info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName); err != nil {
-				return errors.WithMessage(err, "Rollback failed.")
+	if !checkpoint.Done(PhaseHealthCheck) {
+		d.logger.Info(fmt.Sprintf("Start '%s' health check.", info.IdlingTarget.Type))
+		err := d.HealthCheck(ctx,
+			*info.IdlingTarget.TargetGroup.TargetGroupArn,
+			*info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName)
+		if err != nil {
+			if errors.Is(err, RetryTimeout) {
+				return d.rollbackDeploy(ctx, info, false, errors.WithMessage(err, "Health check timed out."))
 			}
-			return CancellationError
+			return err
 		}
-		return err
-	}
 
-	d.logger.Info("Health check completed.")
-	if err := d.ShowStatus(ctx, "table"); err != nil {
-		return err
+		d.logger.Info("Health check completed.")
+		if len(d.config.SmokeTest.Requests) > 0 {
+			d.logger.Info(fmt.Sprintf("Start '%s' smoke test.", info.IdlingTarget.Type))
+			if err := d.SmokeTest(ctx, *info.IdlingTarget.TargetGroup.TargetGroupArn); err != nil {
+				if errors.Is(err, SmokeTestError) {
+					return d.rollbackDeploy(ctx, info, false, errors.WithMessage(err, "Smoke test failed."))
+				}
+				return err
+			}
+			d.logger.Info("Smoke test completed.")
+		}
+		if err := d.runHooks(ctx, HookAfterHealthCheck, info); err != nil {
+			return d.rollbackDeploy(ctx, info, false, err)
+		}
+		if err := d.ShowStatus(ctx, "table"); err != nil {
+			return err
+		}
+		if err := d.saveCheckpoint(ctx, checkpoint, PhaseHealthCheck); err != nil {
+			return err
+		}
 	}
 
-	if swap {
-		d.logger.Info("Start swap traffic.")
-		if err := d.SwapTraffic(ctx, swapDuration); err != nil {
+	if checkpoint.Swap && !checkpoint.Done(PhaseSwap) {
+		if err := d.runHooks(ctx, HookBeforeSwap, info); err != nil {
+			return d.rollbackDeploy(ctx, info, false, err)
+		}
+
+		d.logger.Info(fmt.Sprintf("Start swap traffic. steps: %s", checkpoint.Steps))
+		if err := d.SwapTraffic(ctx, checkpoint.Steps); err != nil {
+			if errors.Is(err, CancellationError) && !interrupted(ctx) {
+				d.logger.Error("Traffic swap cancelled. Initiating a rollback as the process cannot continue.", nil)
+				if err := d.CleanupAutoScalingGroup(ctx, *info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName); err != nil {
+					return errors.WithMessage(err, "Rollback failed.")
+				}
+			}
 			return err
 		}
 
@@ -409,19 +561,25 @@ func (d *Deployer) Deploy(
 		if err := d.ShowStatus(ctx, "table"); err != nil {
 			return err
 		}
+		if err := d.runHooks(ctx, HookAfterSwap, info); err != nil {
+			return d.rollbackDeploy(ctx, info, true, err)
+		}
+		if err := d.saveCheckpoint(ctx, checkpoint, PhaseSwap); err != nil {
+			return err
+		}
 	}
 
-	if cleanupAfterDeploy {
-		info, err := d.GetDeployInfo(ctx)
+	if checkpoint.CleanupAfterDeploy && !checkpoint.Done(PhaseFinalCleanup) {
+		current, err := d.GetDeployInfo(ctx)
 		if err != nil {
 			return err
 		}
 
 		d.logger.Info(fmt.Sprintf(
 			"Update '%s' target MinSize to 0 to clean up instances that are no longer needed. The automatic scale-in will clean up slowly.",
-			info.RunningTarget.Type))
+			current.RunningTarget.Type))
 		err = d.UpdateAutoScalingGroup(ctx,
-			*info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName,
+			*current.IdlingTarget.AutoScalingGroup.AutoScalingGroupName,
 			nil,
 			aws.Int32(0),
 			nil)
@@ -431,15 +589,42 @@ func (d *Deployer) Deploy(
 		if err = d.ShowStatus(ctx, "table"); err != nil {
 			return err
 		}
+		if err := d.runHooks(ctx, HookAfterCleanup, info); err != nil {
+			return d.rollbackDeploy(ctx, info, checkpoint.Swap, err)
+		}
 	}
 
 	return nil
 }
 
+// rollbackDeploy Roll back the deploy that cannot continue, and returns CancellationError with the reason.
+// If the traffic has already been swapped, the original traffic and the capacity of the running target are restored first.
+// Then the target being deployed is cleaned up.
+func (d *Deployer) rollbackDeploy(ctx context.Context, info *DeployInfo, swapped bool, reason error) error {
+	if interrupted(ctx) {
+		// The failure is caused by the cancellation, so leave it to compensateDeploy.
+		return reason
+	}
+	d.logger.Error("Initiating a rollback as the process cannot continue.", reason)
+
+	if swapped {
+		if err := d.restoreTraffic(ctx, info); err != nil {
+			return errors.WithMessage(err, "Rollback failed.")
+		}
+		if err := d.restoreCapacity(ctx, info.RunningTarget); err != nil {
+			return errors.WithMessage(err, "Rollback failed.")
+		}
+	}
+
+	if err := d.CleanupAutoScalingGroup(ctx, *info.IdlingTarget.AutoScalingGroup.AutoScalingGroupName); err != nil {
+		return errors.WithMessage(err, "Rollback failed.")
+	}
+
+	return errors.Wrap(CancellationError, reason.Error())
+}
+
 func (d *Deployer) HealthCheck(ctx context.Context, targetGroupArn string, autoScalingGroupName string) error {
-	maxLimit := d.config.RetryPolicy.MaxLimit
-	interval := aws.Duration(time.Duration(d.config.RetryPolicy.IntervalSeconds) * time.Second)
-	return NewFixedIntervalRetryer(maxLimit, interval).Start(
+	return NewRetryer(d.config.RetryPolicy.HealthCheckStrategy()).Start(ctx,
 		func(index int, interval *time.Duration) (RetryResult, error) {
 			health, err := d.getHealthInfo(ctx, targetGroupArn)
 			if err != nil {
@@ -470,7 +655,13 @@ func (d *Deployer) HealthCheck(ctx context.Context, targetGroupArn string, autoS
 		})
 }
 
-func (d *Deployer) UpdateTraffic(ctx context.Context, blueWeight int32, greenWeight int32) error {
+func (d *Deployer) UpdateTraffic(ctx context.Context, blueWeight int32, greenWeight int32) (err error) {
+	finish, err := d.begin(ctx, "traffic")
+	if err != nil {
+		return err
+	}
+	defer func() { finish(err) }()
+
 	forwardAction := &albTypes.ForwardActionConfig{
 		TargetGroups: []albTypes.TargetGroupTuple{
 			{
@@ -499,7 +690,13 @@ func (d *Deployer) UpdateTraffic(ctx context.Context, blueWeight int32, greenWei
 	return nil
 }
 
-func (d *Deployer) SwapTraffic(ctx context.Context, duration *time.Duration) error {
+func (d *Deployer) SwapTraffic(ctx context.Context, steps TrafficSteps) (err error) {
+	finish, err := d.begin(ctx, "swap")
+	if err != nil {
+		return err
+	}
+	defer func() { finish(err) }()
+
 	rule, err := d.client.GetALBListenerRule(ctx, d.config.ListenerRuleArn)
 	if err != nil {
 		return err
@@ -515,19 +712,202 @@ func (d *Deployer) SwapTraffic(ctx context.Context, duration *time.Duration) err
 		return err
 	}
 
-	if *duration > 0 {
-		d.logger.Info(fmt.Sprintf(
-			"Traffic update to blue->50%%, green->50%%, wait %.0f seconds.", duration.Seconds()))
-		if err := d.UpdateTraffic(ctx, int32(50), int32(50)); err != nil {
+	to, err := getSwapDestination(blue, green, steps)
+	if err != nil {
+		return err
+	}
+
+	if len(steps) > 1 {
+		// Do not start shifting traffic while the service is already in trouble.
+		// Nothing has been shifted yet, so it is cancelled without restoring the traffic.
+		if err := d.checkAlarms(ctx); err != nil {
+			d.logger.Error("The alarms do not allow shifting the traffic.", err)
+			return errors.Wrap(CancellationError, err.Error())
+		}
+	}
+
+	// Once the traffic is shifted, any error other than the interruption restores the previous traffic,
+	// so that the traffic is never left split between the targets.
+	rollback := func(reason error) error {
+		d.logger.Error("The traffic shift failed. Restore the previous traffic.", reason)
+		d.logger.Info(fmt.Sprintf("Traffic update to blue->%d%%, green->%d%%.",
+			*blue.TargetGroup.Weight,
+			*green.TargetGroup.Weight))
+		if err := d.UpdateTraffic(ctx, *blue.TargetGroup.Weight, *green.TargetGroup.Weight); err != nil {
+			return errors.WithMessage(err, "Rollback failed.")
+		}
+		return errors.Wrap(CancellationError, reason.Error())
+	}
+
+	for i, step := range steps {
+		blueWeight, greenWeight := step.getWeights(blue, green, to)
+		d.logger.Info(fmt.Sprintf("Traffic update to blue->%d%%, green->%d%%. (step %d/%d)",
+			blueWeight, greenWeight, i+1, len(steps)))
+		if err := d.UpdateTraffic(ctx, blueWeight, greenWeight); err != nil {
+			if interrupted(ctx) {
+				return d.compensateSwap(ctx, blue, green, err)
+			}
+			if i > 0 {
+				return rollback(err)
+			}
 			return err
 		}
-		time.Sleep(*duration)
+
+		if step.IsFinal() {
+			break
+		}
+
+		startTime := time.Now()
+		d.logger.Info(fmt.Sprintf("Wait %.0f seconds before the next step.", step.BakeTime.Seconds()))
+		if err := d.WatchTargetHealth(ctx, to, step.BakeTime); err != nil {
+			if interrupted(ctx) {
+				return d.compensateSwap(ctx, blue, green, err)
+			}
+			return rollback(err)
+		}
+
+		if d.config.CanaryAnalysis.Enabled {
+			from := blue
+			if to == blue {
+				from = green
+			}
+			endTime := time.Now()
+			if delay := time.Duration(d.config.CanaryAnalysis.MetricDelaySeconds) * time.Second; delay > 0 {
+				// The health is still watched while waiting for the metrics of the bake time to arrive.
+				d.logger.Info(fmt.Sprintf("Wait %.0f seconds for the metrics to reach CloudWatch.", delay.Seconds()))
+				if err := d.WatchTargetHealth(ctx, to, delay); err != nil {
+					if interrupted(ctx) {
+						return d.compensateSwap(ctx, blue, green, err)
+					}
+					return rollback(err)
+				}
+			}
+			if _, err := d.AnalyzeCanary(ctx, to, from, startTime, endTime); err != nil {
+				if interrupted(ctx) {
+					return d.compensateSwap(ctx, blue, green, err)
+				}
+				return rollback(err)
+			}
+		}
 	}
 
-	d.logger.Info(fmt.Sprintf("Traffic update to blue->%d%%, green->%d%%.",
-		*green.TargetGroup.Weight,
-		*blue.TargetGroup.Weight))
-	return d.UpdateTraffic(ctx, *green.TargetGroup.Weight, *blue.TargetGroup.Weight)
+	return nil
+}
+
+// getSwapDestination Returns the target without traffic, which is the destination of the swap.
+// It may be nil only if the traffic is swapped at once.
+func getSwapDestination(blue *DeployTarget, green *DeployTarget, steps TrafficSteps) (*DeployTarget, error) {
+	if *blue.TargetGroup.Weight > int32(0) && *green.TargetGroup.Weight <= int32(0) {
+		return green, nil
+	} else if *green.TargetGroup.Weight > int32(0) && *blue.TargetGroup.Weight <= int32(0) {
+		return blue, nil
+	} else if len(steps) > 1 {
+		return nil, errors.Errorf(
+			"Failed to identify the target to shift traffic to. Either two weighted TargetGroup must be 0")
+	}
+	return nil, nil
+}
+
+// getWeights Returns the weights of blue and green at this step. The final step swaps the original weights.
+func (s *TrafficStep) getWeights(blue *DeployTarget, green *DeployTarget, to *DeployTarget) (int32, int32) {
+	if s.IsFinal() {
+		return *green.TargetGroup.Weight, *blue.TargetGroup.Weight
+	}
+	if to.Type == BlueTargetType {
+		return s.Weight, MaxTrafficWeight - s.Weight
+	}
+	return MaxTrafficWeight - s.Weight, s.Weight
+}
+
+// WatchTargetHealth Poll the health of the target and the alarms until the duration has elapsed.
+// Returns UnhealthyTargetError as soon as the healthy count drops below the threshold of HealthWatch,
+// or AlarmError as soon as any of the alarms goes into ALARM.
+func (d *Deployer) WatchTargetHealth(ctx context.Context, target *DeployTarget, duration time.Duration) error {
+	interval := time.Duration(d.config.HealthWatch.IntervalSeconds) * time.Second
+	deadline := time.Now().Add(duration)
+	for {
+		wait := time.Until(deadline)
+		if wait > interval {
+			wait = interval
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+
+		if err := d.checkTargetHealth(ctx, target); err != nil {
+			return err
+		}
+		if err := d.checkAlarms(ctx); err != nil {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+	}
+}
+
+func (d *Deployer) checkTargetHealth(ctx context.Context, target *DeployTarget) error {
+	health, err := d.getHealthInfo(ctx, *target.TargetGroup.TargetGroupArn)
+	if err != nil {
+		return err
+	}
+
+	autoScalingGroup, err := d.client.DescribeAutoScalingGroup(ctx, *target.AutoScalingGroup.AutoScalingGroupName)
+	if err != nil {
+		return err
+	}
+
+	desiredCount := int(*autoScalingGroup.DesiredCapacity)
+	d.logger.Info(fmt.Sprintf("Health of the '%s' target. desired:%d, total:%d, healthy:%d, unhealthy:%d",
+		target.Type,
+		desiredCount,
+		health.TotalCount,
+		health.HealthyCount,
+		health.UnhealthyCount,
+	))
+	if health.HealthyCount <= 0 || health.HealthyCount*100 < desiredCount*d.config.HealthWatch.MinHealthyPercent {
+		return errors.Wrapf(UnhealthyTargetError, "The '%s' target is not healthy. desired:%d, healthy:%d, minHealthyPercent:%d",
+			target.Type, desiredCount, health.HealthyCount, d.config.HealthWatch.MinHealthyPercent)
+	}
+
+	return nil
+}
+
+func (d *Deployer) checkAlarms(ctx context.Context) error {
+	alarmNames := d.config.HealthWatch.AlarmNames
+	if len(alarmNames) == 0 {
+		return nil
+	}
+
+	output, err := describeCloudWatchAlarms(ctx, d.client, alarmNames)
+	if err != nil {
+		// Without the states, the service cannot be regarded as fine. The throttling is already retried by the client.
+		return errors.Wrapf(AlarmError, "Failed to describe the CloudWatch alarms. %s", err)
+	}
+
+	states := map[string]cwTypes.StateValue{}
+	for _, alarm := range output.MetricAlarms {
+		states[*alarm.AlarmName] = alarm.StateValue
+	}
+	for _, alarm := range output.CompositeAlarms {
+		states[*alarm.AlarmName] = alarm.StateValue
+	}
+
+	var alarming []string
+	for _, name := range alarmNames {
+		state, ok := states[name]
+		if !ok {
+			return errors.Wrapf(AlarmError, "CloudWatch alarm not found. name:%s", name)
+		}
+		if state == cwTypes.StateValueAlarm {
+			alarming = append(alarming, name)
+		}
+	}
+	if len(alarming) > 0 {
+		return errors.Wrapf(AlarmError, "CloudWatch alarms are in ALARM. names:%s", strings.Join(alarming, ", "))
+	}
+
+	return nil
 }
 
 func (d *Deployer) UpdateAutoScalingGroup(
@@ -537,7 +917,13 @@ func (d *Deployer) UpdateAutoScalingGroup(
 }
 
 func (d *Deployer) UpdateAutoScalingGroupByTarget(
-	ctx context.Context, targetType TargetType, desiredCapacity *int32, minSize *int32, maxSize *int32) error {
+	ctx context.Context, targetType TargetType, desiredCapacity *int32, minSize *int32, maxSize *int32) (err error) {
+
+	finish, err := d.begin(ctx, "autoscaling")
+	if err != nil {
+		return err
+	}
+	defer func() { finish(err) }()
 
 	rule, err := d.client.GetALBListenerRule(ctx, d.config.ListenerRuleArn)
 	if err != nil {
@@ -561,15 +947,19 @@ func (d *Deployer) UpdateAutoScalingGroupByTarget(
 	return nil
 }
 
-func (d *Deployer) CleanupAutoScalingGroup(ctx context.Context, autoScalingGroupName string) error {
+func (d *Deployer) CleanupAutoScalingGroup(ctx context.Context, autoScalingGroupName string) (err error) {
+	finish, err := d.begin(ctx, "cleanup")
+	if err != nil {
+		return err
+	}
+	defer func() { finish(err) }()
+
 	if err := d.UpdateAutoScalingGroup(
 		ctx, autoScalingGroupName, aws.Int32(0), aws.Int32(0), nil); err != nil {
 		return err
 	}
 
-	maxLimit := d.config.RetryPolicy.MaxLimit
-	interval := aws.Duration(time.Duration(d.config.RetryPolicy.IntervalSeconds) * time.Second)
-	return NewFixedIntervalRetryer(maxLimit, interval).Start(
+	return NewRetryer(d.config.RetryPolicy.CleanupStrategy()).Start(ctx,
 		func(index int, interval *time.Duration) (RetryResult, error) {
 			current, err := d.client.DescribeAutoScalingGroup(ctx, autoScalingGroupName)
 			if err != nil {
@@ -597,7 +987,7 @@ func (d *Deployer) CleanupAutoScalingGroup(ctx context.Context, autoScalingGroup
 func (d *Deployer) MoveScheduledActions(
 	ctx context.Context, fromAutoScalingGroupName string, toAutoScalingGroupName string) error {
 
-	fromActions, err := d.client.DescribeScheduledActions(ctx, fromAutoScalingGroupName)
+	fromActions, err := describeScheduledActions(ctx, d.client, fromAutoScalingGroupName)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+const HistoryPrefix string = "history/"
+
+const (
+	HistoryResultSucceeded = "succeeded"
+	HistoryResultFailed    = "failed"
+	HistoryResultCancelled = "cancelled"
+)
+
+type HistoryRecord struct {
+	ID            string            `json:"id"`
+	Operation     string            `json:"operation"`
+	Actor         string            `json:"actor"`
+	Host          string            `json:"host"`
+	Command       string            `json:"command"`
+	StartedAt     time.Time         `json:"startedAt"`
+	FinishedAt    time.Time         `json:"finishedAt"`
+	Before        []TargetStatus    `json:"before"`
+	After         []TargetStatus    `json:"after"`
+	ActiveBundles map[string]string `json:"activeBundles"`
+	Result        string            `json:"result"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func newHistoryRecord(operation string) *HistoryRecord {
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+
+	return &HistoryRecord{
+		ID:            hex.EncodeToString(id),
+		Operation:     operation,
+		Actor:         currentOwner(),
+		Host:          currentHost(),
+		Command:       currentCommand(),
+		StartedAt:     time.Now(),
+		ActiveBundles: map[string]string{},
+	}
+}
+
+// Key Object keys are sortable by the start time.
+func (r *HistoryRecord) Key() string {
+	return fmt.Sprintf("%s%s-%s.json", HistoryPrefix, r.StartedAt.UTC().Format("20060102T150405Z"), r.ID)
+}
+
+func (r *HistoryRecord) Finish(err error) {
+	r.FinishedAt = time.Now()
+	switch {
+	case err == nil:
+		r.Result = HistoryResultSucceeded
+	case errors.Is(err, CancellationError):
+		r.Result = HistoryResultCancelled
+		r.Error = err.Error()
+	default:
+		r.Result = HistoryResultFailed
+		r.Error = err.Error()
+	}
+}
+
+type HistoryOutput struct {
+	BucketName string          `json:"bucket"`
+	Records    []HistoryRecord `json:"records"`
+	location   *time.Location
+}
+
+func (h *HistoryOutput) AsJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(h)
+}
+
+func (h *HistoryOutput) AsTable(w io.Writer) error {
+	traffic := func(targets []TargetStatus) string {
+		var parts []string
+		for _, target := range targets {
+			parts = append(parts, fmt.Sprintf("%s:%d", target.TargetType, target.TrafficWeight))
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	var data [][]string
+	for i, record := range h.Records {
+		bundles := []string{}
+		for _, targetType := range []TargetType{BlueTargetType, GreenTargetType} {
+			if name, ok := record.ActiveBundles[string(targetType)]; ok {
+				bundles = append(bundles, fmt.Sprintf("%s:%s", targetType, name))
+			}
+		}
+		data = append(data, []string{
+			strconv.Itoa(i + 1),
+			record.StartedAt.In(h.location).Format(time.RFC3339),
+			record.FinishedAt.Sub(record.StartedAt).Round(time.Second).String(),
+			record.Operation,
+			record.Actor + "@" + record.Host,
+			traffic(record.Before),
+			traffic(record.After),
+			strings.Join(bundles, ", "),
+			record.Result,
+		})
+	}
+
+	fmt.Fprintf(w, "Bucket: %s\n", h.BucketName)
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"#", "started at", "duration", "operation", "actor", "traffic before", "traffic after", "active bundles", "result"})
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+// History Deployment history stored in the bundle bucket. One object is written per operation.
+type History struct {
+	config *Config
+	client AwsClient
+	logger Logger
+}
+
+func NewHistory(deployConfig *Config, awsClient AwsClient, logger Logger) *History {
+	return &History{
+		config: deployConfig,
+		client: awsClient,
+		logger: logger,
+	}
+}
+
+func (h *History) GetActiveBundles(ctx context.Context) (map[string]string, error) {
+	bundles := map[string]string{}
+	for _, targetType := range []TargetType{BlueTargetType, GreenTargetType} {
+		bundle, err := getActiveBundle(ctx, h.client, h.config.BundleBucket, targetType)
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+				continue
+			}
+			return nil, err
+		}
+		bundles[string(targetType)] = bundle.Value
+	}
+	return bundles, nil
+}
+
+func (h *History) Append(ctx context.Context, record *HistoryRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return h.client.PutS3BucketObjectAsTextFile(ctx, h.config.BundleBucket, record.Key(), string(raw))
+}
+
+// List Returns the latest records in descending order of the start time.
+func (h *History) List(ctx context.Context, limit int) ([]HistoryRecord, error) {
+	objects, err := listS3BucketObjects(ctx, h.client, h.config.BundleBucket, HistoryPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// desc sort
+	sort.Slice(objects, func(i, j int) bool {
+		return *objects[i].Key > *objects[j].Key
+	})
+	if limit > 0 && len(objects) > limit {
+		objects = objects[:limit]
+	}
+
+	var records []HistoryRecord
+	for _, object := range objects {
+		output, err := h.client.GetS3BucketObject(ctx, h.config.BundleBucket, *object.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(output.Body); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		var record HistoryRecord
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (h *History) ShowHistory(ctx context.Context, outputFormat string, limit int) error {
+	records, err := h.List(ctx, limit)
+	if err != nil {
+		return err
+	}
+
+	output := &HistoryOutput{
+		BucketName: h.config.BundleBucket,
+		Records:    records,
+		location:   h.config.TimeZone.CurrentLocation(),
+	}
+
+	if outputFormat == "json" {
+		return output.AsJSON(os.Stdout)
+	}
+	return output.AsTable(os.Stdout)
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type HookPoint string
+
+const (
+	HookBeforeCleanup    HookPoint = "beforeCleanup"
+	HookAfterScaleUp     HookPoint = "afterScaleUp"
+	HookAfterHealthCheck HookPoint = "afterHealthCheck"
+	HookBeforeSwap       HookPoint = "beforeSwap"
+	HookAfterSwap        HookPoint = "afterSwap"
+	HookAfterCleanup     HookPoint = "afterCleanup"
+)
+
+var HookError = errors.New("HookError")
+
+// Commands Returns the commands to be run at the point.
+func (h *Hooks) Commands(point HookPoint) []string {
+	switch point {
+	case HookBeforeCleanup:
+		return h.BeforeCleanup
+	case HookAfterScaleUp:
+		return h.AfterScaleUp
+	case HookAfterHealthCheck:
+		return h.AfterHealthCheck
+	case HookBeforeSwap:
+		return h.BeforeSwap
+	case HookAfterSwap:
+		return h.AfterSwap
+	case HookAfterCleanup:
+		return h.AfterCleanup
+	}
+	return nil
+}
+
+func hookEnv(point HookPoint, bucket string, info *DeployInfo) []string {
+	env := []string{
+		"DEPLOYMAN_HOOK=" + string(point),
+		"DEPLOYMAN_BUNDLE_BUCKET=" + bucket,
+	}
+	targets := []struct {
+		prefix string
+		target *DeployTarget
+	}{
+		{"DEPLOYMAN_IDLING_", info.IdlingTarget},
+		{"DEPLOYMAN_RUNNING_", info.RunningTarget},
+	}
+	for _, t := range targets {
+		env = append(env,
+			t.prefix+"TARGET="+string(t.target.Type),
+			t.prefix+"AUTO_SCALING_GROUP_NAME="+*t.target.AutoScalingGroup.AutoScalingGroupName,
+			t.prefix+"TARGET_GROUP_ARN="+*t.target.TargetGroup.TargetGroupArn,
+		)
+	}
+	return env
+}
+
+// runHooks Run the commands of the point in order. The DeployInfo at the start of the deploy is passed as JSON on stdin and as environment variables.
+// Returns HookError as soon as a command exits with non-zero.
+func (d *Deployer) runHooks(ctx context.Context, point HookPoint, info *DeployInfo) error {
+	commands := d.config.Hooks.Commands(point)
+	if len(commands) == 0 {
+		return nil
+	}
+
+	input, err := json.Marshal(info)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, command := range commands {
+		d.logger.Info(fmt.Sprintf("Run '%s' hook. command: '%s'", point, command))
+
+		hookCtx, cancel := context.WithTimeout(ctx, time.Duration(d.config.Hooks.TimeoutSeconds)*time.Second)
+		cmd := exec.CommandContext(hookCtx, "sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), hookEnv(point, d.config.BundleBucket, info)...)
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			return errors.Wrapf(HookError, "'%s' hook failed. command: '%s', %s", point, command, err)
+		}
+	}
+
+	d.logger.Info(fmt.Sprintf("'%s' hook completed.", point))
+	return nil
+}
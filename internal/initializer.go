@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/pkg/errors"
+)
+
+// initialConfig The required values of the config. The others are left to the defaults.
+type initialConfig struct {
+	BundleBucket    string     `json:"bundleBucket"`
+	ListenerRuleArn string     `json:"listenerRuleArn"`
+	Target          *TargetSet `json:"target"`
+}
+
+// Initializer Generates the config from the resources that the listener rule forwards to.
+type Initializer struct {
+	client AwsClient
+	logger Logger
+}
+
+func NewInitializer(awsClient AwsClient, logger Logger) *Initializer {
+	return &Initializer{
+		client: awsClient,
+		logger: logger,
+	}
+}
+
+// Discover Returns the validated config of the listener rule as JSON. The first target group of the forward action is blue,
+// and the second is green. The bundle bucket is suggested from the load balancer name and the account if it is empty.
+func (i *Initializer) Discover(ctx context.Context, listenerRuleArn string, bundleBucket string) ([]byte, error) {
+	rule, err := i.client.GetALBListenerRule(ctx, listenerRuleArn)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetGroupArns []string
+	for _, action := range rule.Actions {
+		if action.Type != albTypes.ActionTypeEnumForward {
+			continue
+		}
+		if action.ForwardConfig != nil {
+			for _, tg := range action.ForwardConfig.TargetGroups {
+				targetGroupArns = append(targetGroupArns, *tg.TargetGroupArn)
+			}
+		} else if action.TargetGroupArn != nil {
+			targetGroupArns = append(targetGroupArns, *action.TargetGroupArn)
+		}
+	}
+	if len(targetGroupArns) != 2 {
+		return nil, errors.Errorf("The forward action of the listener rule must have 2 target groups for blue and green, but has %d.", len(targetGroupArns))
+	}
+
+	autoScalingGroups, err := listAutoScalingGroups(ctx, i.client)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]*Target, len(targetGroupArns))
+	for x, targetGroupArn := range targetGroupArns {
+		var names []string
+		for _, group := range autoScalingGroups {
+			if slices.Contains(group.TargetGroupARNs, targetGroupArn) {
+				names = append(names, *group.AutoScalingGroupName)
+			}
+		}
+		if len(names) != 1 {
+			return nil, errors.Errorf("Exactly one AutoScalingGroup must be attached to the target group, but %d are attached. targetGroupArn:%s, autoScalingGroups:%v",
+				len(names), targetGroupArn, names)
+		}
+		targets[x] = &Target{AutoScalingGroupName: names[0], TargetGroupArn: targetGroupArn}
+	}
+	i.logger.Info(fmt.Sprintf("Found blue. autoScalingGroup:%s, targetGroup:%s", targets[0].AutoScalingGroupName, targets[0].TargetGroupArn))
+	i.logger.Info(fmt.Sprintf("Found green. autoScalingGroup:%s, targetGroup:%s", targets[1].AutoScalingGroupName, targets[1].TargetGroupArn))
+
+	if bundleBucket == "" {
+		bundleBucket = suggestBundleBucket(listenerRuleArn)
+		i.logger.Info(fmt.Sprintf("Suggest '%s' for the bundle bucket. It is created by the first 'bundle register' if it does not exist.", bundleBucket))
+	}
+
+	raw, err := json.MarshalIndent(&initialConfig{
+		BundleBucket:    bundleBucket,
+		ListenerRuleArn: listenerRuleArn,
+		Target:          &TargetSet{Blue: targets[0], Green: targets[1]},
+	}, "", "  ")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := parseConfig(raw, false, ""); err != nil {
+		return nil, err
+	}
+
+	return append(raw, '\n'), nil
+}
+
+// Write Write the config to the file, or to the SSM parameter if the filepath is 'ssm:<parameter name>'.
+// An existing config is overwritten only if force is true.
+func (i *Initializer) Write(ctx context.Context, raw []byte, filepath string, force bool) error {
+	if strings.HasPrefix(filepath, "ssm:") {
+		ssmParameterName := strings.TrimPrefix(filepath, "ssm:")
+		if err := i.client.PutSSMParameter(ctx, ssmParameterName, string(raw), force); err != nil {
+			return err
+		}
+		i.logger.Info(fmt.Sprintf("Config is stored in the SSM parameter. name:%s", ssmParameterName))
+		return nil
+	}
+
+	if _, err := os.Stat(filepath); err == nil && !force {
+		return errors.Errorf("'%s' already exists. Use --force to overwrite it.", filepath)
+	}
+	if err := os.WriteFile(filepath, raw, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	i.logger.Info(fmt.Sprintf("Config is written to '%s'.", filepath))
+	return nil
+}
+
+// suggestBundleBucket Returns '<load balancer name>-deployman-<account>' from the listener rule ARN,
+// e.g. 'arn:aws:elasticloadbalancing:region:account:listener-rule/app/name/...'.
+func suggestBundleBucket(listenerRuleArn string) string {
+	parts := strings.SplitN(listenerRuleArn, ":", 6)
+	if len(parts) < 6 {
+		return "deployman-bundle"
+	}
+	resource := strings.Split(parts[5], "/")
+	name := "deployman"
+	if len(resource) > 2 {
+		name = resource[2] + "-deployman"
+	}
+	if parts[4] != "" {
+		name += "-" + parts[4]
+	}
+
+	bucket := strings.ToLower(name)
+	if len(bucket) > 63 {
+		bucket = bucket[:63]
+	}
+	return strings.TrimRight(bucket, "-.")
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	envReferencePattern = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+	envNamePattern      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// isYamlConfig Whether the config is YAML. The file is judged by the extension, and the SSM parameter by the content.
+func isYamlConfig(filepath string, raw []byte) bool {
+	if strings.HasPrefix(filepath, "ssm:") {
+		return !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{"))
+	}
+	ext := strings.ToLower(path.Ext(filepath))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// normalizeConfig Returns the config as JSON with the environment variables interpolated into every string value.
+// The environments other than env are emptied first, so that their variables need not be set.
+func normalizeConfig(raw []byte, isYaml bool, env string) ([]byte, error) {
+	var document any
+	if isYaml {
+		if err := yaml.Unmarshal(raw, &document); err != nil {
+			return nil, errors.Wrap(err, "Invalid YAML config.")
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return nil, errors.Wrap(err, "Invalid JSON config.")
+		}
+	}
+
+	if root, ok := document.(map[string]any); ok {
+		if environments, ok := root["environments"].(map[string]any); ok {
+			for name := range environments {
+				if name != env {
+					environments[name] = map[string]any{}
+				}
+			}
+		}
+	}
+
+	document, err := interpolateEnv(document, "")
+	if err != nil {
+		return nil, err
+	}
+
+	normalized, err := json.Marshal(document)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return normalized, nil
+}
+
+// interpolateEnv Replace ${NAME} and ${NAME:-default} in the string values with the environment variables.
+// The field is named by the path such as 'target.blue.autoScalingGroupName' in the errors.
+// The keys are visited in order, so that the same config always fails with the same error.
+func interpolateEnv(value any, field string) (any, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			child := v[key]
+			childField := key
+			if field != "" {
+				childField = field + "." + key
+			}
+			replaced, err := interpolateEnv(child, childField)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = replaced
+		}
+	case []any:
+		for i, child := range v {
+			replaced, err := interpolateEnv(child, fmt.Sprintf("%s[%d]", field, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = replaced
+		}
+	case string:
+		return expandEnv(v, field)
+	}
+	return value, nil
+}
+
+// expandEnv As the shell, the default is used if the variable is unset or empty.
+// An unset variable without the default is an error rather than an empty string.
+// $${NAME} is left as the literal ${NAME}, e.g. for the hook commands that read the variables by themselves.
+func expandEnv(value string, field string) (string, error) {
+	if strings.Contains(envReferencePattern.ReplaceAllString(value, ""), "${") {
+		return "", errors.Errorf("Unclosed reference in '%s' of the config. value: '%s'", field, value)
+	}
+
+	var err error
+	expanded := envReferencePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		if err != nil {
+			return ""
+		}
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+		name, fallback, hasDefault := strings.Cut(reference[2:len(reference)-1], ":-")
+		if !envNamePattern.MatchString(name) {
+			err = errors.Errorf("Invalid reference '%s' in '%s' of the config. Use ${NAME} or ${NAME:-default}.", reference, field)
+			return ""
+		}
+		env, ok := os.LookupEnv(name)
+		if hasDefault && env == "" {
+			return fallback
+		}
+		if !ok {
+			err = errors.Errorf("The environment variable '%s' referenced in '%s' of the config is not set.", name, field)
+			return ""
+		}
+		return env
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LabelGitCommit = "git-commit"
+	LabelGitBranch = "git-branch"
+	LabelGitAuthor = "git-author"
+	LabelBuildUrl  = "build-url"
+)
+
+// DefaultBundleColumns Labels shown by 'bundle list' unless the columns are given.
+var DefaultBundleColumns = []string{LabelGitCommit, LabelGitBranch}
+
+// labelKeyPattern Labels are stored as the S3 object metadata, so the key must be a valid header name that S3 does not change.
+var labelKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// normalizeLabels Returns the labels with the lowercase keys. The key of the checksum is reserved.
+func normalizeLabels(labels map[string]string) (map[string]string, error) {
+	normalized := map[string]string{}
+	for key, value := range labels {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !labelKeyPattern.MatchString(key) {
+			return nil, errors.Errorf("Invalid label key '%s'. Use lowercase letters, digits, '.', '_' and '-'.", key)
+		}
+		if key == ChecksumMetadataKey {
+			return nil, errors.Errorf("The label key '%s' is reserved.", key)
+		}
+		normalized[key] = value
+	}
+	return normalized, nil
+}
+
+// detectLabels Returns the git commit, branch and author of the current directory, and the build URL of the CI if any.
+// They are skipped outside a git repository or CI.
+func detectLabels(ctx context.Context) map[string]string {
+	labels := map[string]string{}
+	git := func(args ...string) string {
+		output, err := exec.CommandContext(ctx, "git", args...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(output))
+	}
+	if commit := git("rev-parse", "HEAD"); commit != "" {
+		labels[LabelGitCommit] = commit
+		if branch := git("rev-parse", "--abbrev-ref", "HEAD"); branch != "" && branch != "HEAD" {
+			labels[LabelGitBranch] = branch
+		}
+		if author := git("log", "-1", "--format=%an <%ae>"); author != "" {
+			labels[LabelGitAuthor] = author
+		}
+	}
+
+	switch {
+	case os.Getenv("GITHUB_RUN_ID") != "":
+		labels[LabelBuildUrl] = os.Getenv("GITHUB_SERVER_URL") + "/" + os.Getenv("GITHUB_REPOSITORY") + "/actions/runs/" + os.Getenv("GITHUB_RUN_ID")
+	case os.Getenv("CI_JOB_URL") != "":
+		labels[LabelBuildUrl] = os.Getenv("CI_JOB_URL")
+	case os.Getenv("CIRCLE_BUILD_URL") != "":
+		labels[LabelBuildUrl] = os.Getenv("CIRCLE_BUILD_URL")
+	case os.Getenv("BUILD_URL") != "":
+		labels[LabelBuildUrl] = os.Getenv("BUILD_URL")
+	}
+	return labels
+}
+
+// encodeLabels The values are escaped, as S3 accepts only US-ASCII in the metadata.
+func encodeLabels(labels map[string]string) map[string]string {
+	encoded := map[string]string{}
+	for key, value := range labels {
+		encoded[key] = url.PathEscape(value)
+	}
+	return encoded
+}
+
+// decodeLabels Returns the labels in the object metadata, except the checksum.
+func decodeLabels(metadata map[string]string) map[string]string {
+	labels := map[string]string{}
+	for key, value := range metadata {
+		key = strings.ToLower(key)
+		if key == ChecksumMetadataKey {
+			continue
+		}
+		if decoded, err := url.PathUnescape(value); err == nil {
+			value = decoded
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// matchLabels Whether the labels have all the filters.
+func matchLabels(labels map[string]string, filters map[string]string) bool {
+	for key, value := range filters {
+		if labels[strings.ToLower(key)] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+const (
+	LockKey        string        = "deployman.lock"
+	LockExpiration time.Duration = 60 * time.Minute
+)
+
+var LockedError = errors.New("LockedError")
+
+type Lock struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	Host       string    `json:"host"`
+	Command    string    `json:"command"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+func newLock() *Lock {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	now := time.Now()
+	return &Lock{
+		ID:         hex.EncodeToString(id),
+		Owner:      currentOwner(),
+		Host:       currentHost(),
+		Command:    currentCommand(),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(LockExpiration),
+	}
+}
+
+func currentOwner() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return GetEnv("USER", "unknown")
+}
+
+func currentHost() string {
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "unknown"
+}
+
+func currentCommand() string {
+	return strings.Join(append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...), " ")
+}
+
+func (l *Lock) IsExpired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+func (l *Lock) String() string {
+	return fmt.Sprintf("owner:%s, host:%s, command:'%s', expires:%s",
+		l.Owner, l.Host, l.Command, l.ExpiresAt.Format(time.RFC3339))
+}
+
+type LockStatusOutput struct {
+	BucketName string `json:"bucket"`
+	Key        string `json:"key"`
+	Lock       *Lock  `json:"lock"`
+	Expired    bool   `json:"expired"`
+}
+
+func (o *LockStatusOutput) AsJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(o)
+}
+
+func (o *LockStatusOutput) AsTable(w io.Writer, location *time.Location) error {
+	fmt.Fprintf(w, "Lock: s3://%s/%s\n", o.BucketName, o.Key)
+	if o.Lock == nil {
+		fmt.Fprintln(w, "Not locked.")
+		return nil
+	}
+
+	status := "locked"
+	if o.Expired {
+		status = "expired"
+	}
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"status", "owner", "host", "command", "acquired at", "expires at"})
+	table.Append([]string{
+		status,
+		o.Lock.Owner,
+		o.Lock.Host,
+		o.Lock.Command,
+		o.Lock.AcquiredAt.In(location).Format(time.RFC3339),
+		o.Lock.ExpiresAt.In(location).Format(time.RFC3339),
+	})
+	table.Render()
+
+	return nil
+}
+
+// Locker Mutual exclusion of deployment operations by a lock object in the bundle bucket.
+// The lock is reentrant within a Locker, so nested operations (e.g. Deploy -> SwapTraffic) share one lock.
+type Locker struct {
+	config *Config
+	client AwsClient
+	logger Logger
+	held   *Lock
+	depth  int
+}
+
+func NewLocker(deployConfig *Config, awsClient AwsClient, logger Logger) *Locker {
+	return &Locker{
+		config: deployConfig,
+		client: awsClient,
+		logger: logger,
+	}
+}
+
+// GetLock Returns the current lock and its ETag, or nil if there is no lock.
+func (l *Locker) GetLock(ctx context.Context) (*Lock, string, error) {
+	output, err := l.client.GetS3BucketObject(ctx, l.config.BundleBucket, LockKey)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(output.Body); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	lock := &Lock{}
+	if err := json.Unmarshal(buf.Bytes(), lock); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	var etag string
+	if output.ETag != nil {
+		etag = *output.ETag
+	}
+
+	return lock, etag, nil
+}
+
+func (l *Locker) Acquire(ctx context.Context) error {
+	return l.acquire(ctx, nil)
+}
+
+// TakeOver Acquire the lock as Acquire, but also take over the unexpired lock that matches,
+// such as the one left by the killed process of the deployment being resumed.
+func (l *Locker) TakeOver(ctx context.Context, matches func(current *Lock) bool) error {
+	return l.acquire(ctx, matches)
+}
+
+func (l *Locker) acquire(ctx context.Context, matches func(current *Lock) bool) error {
+	if l.held != nil {
+		l.depth++
+		return nil
+	}
+
+	lock := newLock()
+	raw, err := json.Marshal(lock)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = l.client.PutS3BucketObjectAsTextFileIfNotExists(ctx, l.config.BundleBucket, LockKey, string(raw))
+	if err != nil {
+		if !isPreconditionFailed(err) {
+			return err
+		}
+
+		current, etag, err := l.GetLock(ctx)
+		if err != nil {
+			return err
+		}
+		if current != nil && !current.IsExpired() {
+			if matches == nil || !matches(current) {
+				return errors.Wrapf(LockedError, "Another deployment is in progress. %s", current)
+			}
+			l.logger.Warn(fmt.Sprintf("Take over the lock left by the interrupted deployment. %s", current), nil)
+		} else if current != nil {
+			l.logger.Warn(fmt.Sprintf("Take over an expired lock. %s", current), nil)
+		}
+
+		// The lock has expired or has just been released, so take it over only if nobody else did it first.
+		if etag == "" {
+			err = l.client.PutS3BucketObjectAsTextFileIfNotExists(ctx, l.config.BundleBucket, LockKey, string(raw))
+		} else {
+			err = l.client.PutS3BucketObjectAsTextFileIfMatch(ctx, l.config.BundleBucket, LockKey, string(raw), etag)
+		}
+		if err != nil {
+			if isPreconditionFailed(err) {
+				return errors.Wrap(LockedError, "Another deployment acquired the lock first.")
+			}
+			return err
+		}
+	}
+
+	l.logger.Debug(fmt.Sprintf("Lock acquired. %s", lock))
+	l.held = lock
+	l.depth = 1
+
+	return nil
+}
+
+func (l *Locker) Release(ctx context.Context) error {
+	if l.held == nil {
+		return nil
+	}
+	l.depth--
+	if l.depth > 0 {
+		return nil
+	}
+
+	held := l.held
+	l.held = nil
+
+	current, etag, err := l.GetLock(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.ID != held.ID {
+		l.logger.Warn("The lock has already been released or taken over by another deployment.", nil)
+		return nil
+	}
+
+	if err := l.client.DeleteS3BucketObjectIfMatch(ctx, l.config.BundleBucket, LockKey, etag); err != nil {
+		return err
+	}
+	l.logger.Debug(fmt.Sprintf("Lock released. %s", held))
+
+	return nil
+}
+
+// Unlock Remove the lock. Unless force is true, only the lock acquired by the same owner and host can be removed.
+func (l *Locker) Unlock(ctx context.Context, force bool) error {
+	current, etag, err := l.GetLock(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		l.logger.Info("Not locked.")
+		return nil
+	}
+
+	if !force && !current.IsExpired() && (current.Owner != currentOwner() || current.Host != currentHost()) {
+		return errors.Wrapf(LockedError, "The lock is held by another owner. Use '--force' to release it. %s", current)
+	}
+
+	if err := l.client.DeleteS3BucketObjectIfMatch(ctx, l.config.BundleBucket, LockKey, etag); err != nil {
+		return err
+	}
+	l.logger.Info(fmt.Sprintf("Lock released. %s", current))
+
+	return nil
+}
+
+func (l *Locker) ShowStatus(ctx context.Context, outputFormat string) error {
+	current, _, err := l.GetLock(ctx)
+	if err != nil {
+		return err
+	}
+
+	output := &LockStatusOutput{
+		BucketName: l.config.BundleBucket,
+		Key:        LockKey,
+		Lock:       current,
+		Expired:    current != nil && current.IsExpired(),
+	}
+
+	if outputFormat == "json" {
+		return output.AsJSON(os.Stdout)
+	}
+	return output.AsTable(os.Stdout, l.config.TimeZone.CurrentLocation())
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	PlanActionAutoScaling     = "autoscaling"
+	PlanActionTraffic         = "traffic"
+	PlanActionScheduledAction = "scheduled-action"
+	PlanActionWait            = "wait"
+	PlanActionHook            = "hook"
+	PlanActionSmokeTest       = "smoke-test"
+	PlanActionCanary          = "canary-analysis"
+)
+
+type PlanAction struct {
+	Number int    `json:"number"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Change string `json:"change"`
+}
+
+// Plan Ordered list of changes that a command would make. It is built only from read-only API calls.
+type Plan struct {
+	Command string       `json:"command"`
+	Actions []PlanAction `json:"actions"`
+}
+
+func newPlan(command string) *Plan {
+	return &Plan{Command: command, Actions: []PlanAction{}}
+}
+
+func (p *Plan) add(action string, target string, format string, args ...any) {
+	p.Actions = append(p.Actions, PlanAction{
+		Number: len(p.Actions) + 1,
+		Action: action,
+		Target: target,
+		Change: fmt.Sprintf(format, args...),
+	})
+}
+
+// addAutoScaling Add a capacity change. The given AutoScalingGroup is updated so that the following actions are planned from the new capacity.
+func (p *Plan) addAutoScaling(autoScalingGroup *asgTypes.AutoScalingGroup, desiredCapacity *int32, minSize *int32, maxSize *int32) {
+	change := func(name string, current **int32, next *int32) string {
+		if next == nil || *next < 0 || *next == **current {
+			return fmt.Sprintf("%s:%d", name, **current)
+		}
+		from := **current
+		*current = aws.Int32(*next)
+		return fmt.Sprintf("%s:%d->%d", name, from, *next)
+	}
+	p.add(PlanActionAutoScaling, *autoScalingGroup.AutoScalingGroupName, "%s, %s, %s",
+		change("desired", &autoScalingGroup.DesiredCapacity, desiredCapacity),
+		change("min", &autoScalingGroup.MinSize, minSize),
+		change("max", &autoScalingGroup.MaxSize, maxSize))
+}
+
+func (p *Plan) addHooks(hooks *Hooks, point HookPoint) {
+	for _, command := range hooks.Commands(point) {
+		p.add(PlanActionHook, string(point), "run '%s'", command)
+	}
+}
+
+func (p *Plan) addTraffic(currentBlueWeight int32, currentGreenWeight int32, blueWeight int32, greenWeight int32) {
+	p.add(PlanActionTraffic, "listener rule", "blue:%d->%d, green:%d->%d",
+		currentBlueWeight, blueWeight, currentGreenWeight, greenWeight)
+}
+
+func (p *Plan) AsJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+func (p *Plan) AsTable(w io.Writer) error {
+	var data [][]string
+	for _, action := range p.Actions {
+		data = append(data, []string{
+			strconv.Itoa(action.Number),
+			action.Action,
+			action.Target,
+			action.Change,
+		})
+	}
+
+	fmt.Fprintf(w, "Plan: %s (dry-run, nothing has been changed)\n", p.Command)
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"#", "action", "target", "change"})
+	table.SetAutoWrapText(false)
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func (p *Plan) Show(outputFormat string) error {
+	if outputFormat == "json" {
+		return p.AsJSON(os.Stdout)
+	}
+	return p.AsTable(os.Stdout)
+}
+
+func (d *Deployer) getTargets(ctx context.Context) (*DeployTarget, *DeployTarget, error) {
+	rule, err := d.client.GetALBListenerRule(ctx, d.config.ListenerRuleArn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blue, err := d.GetDeployTarget(ctx, rule, BlueTargetType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	green, err := d.GetDeployTarget(ctx, rule, GreenTargetType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return blue, green, nil
+}
+
+func (d *Deployer) planSwapTraffic(plan *Plan, blue *DeployTarget, green *DeployTarget, steps TrafficSteps) error {
+	to, err := getSwapDestination(blue, green, steps)
+	if err != nil {
+		return err
+	}
+
+	blueWeight, greenWeight := *blue.TargetGroup.Weight, *green.TargetGroup.Weight
+	for _, step := range steps {
+		nextBlueWeight, nextGreenWeight := step.getWeights(blue, green, to)
+		plan.addTraffic(blueWeight, greenWeight, nextBlueWeight, nextGreenWeight)
+		blueWeight, greenWeight = nextBlueWeight, nextGreenWeight
+		if !step.IsFinal() {
+			watch := fmt.Sprintf("min healthy %d%%", d.config.HealthWatch.MinHealthyPercent)
+			if len(d.config.HealthWatch.AlarmNames) > 0 {
+				watch += ", alarms: " + strings.Join(d.config.HealthWatch.AlarmNames, ", ")
+			}
+			plan.add(PlanActionWait, string(to.Type), "bake %s while watching health (%s)", step.BakeTime, watch)
+			if d.config.CanaryAnalysis.Enabled {
+				plan.add(PlanActionCanary, string(to.Type), "compare 5xx rate and response time with the old target")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *Deployer) PlanDeploy(
+	ctx context.Context, swap bool,
+	cleanupBeforeDeploy bool,
+	cleanupAfterDeploy bool,
+	steps TrafficSteps) (*Plan, error) {
+
+	command := "ec2 deploy"
+	if !cleanupBeforeDeploy {
+		command = "ec2 rollback"
+	}
+	plan := newPlan(command)
+
+	info, err := d.GetDeployInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idle := info.IdlingTarget
+	running := info.RunningTarget
+	idleGroup, runningGroup := *idle.AutoScalingGroup, *running.AutoScalingGroup
+
+	if cleanupBeforeDeploy {
+		plan.addHooks(d.config.Hooks, HookBeforeCleanup)
+		plan.addAutoScaling(&idleGroup, aws.Int32(0), aws.Int32(0), nil)
+		plan.add(PlanActionWait, string(idle.Type), "until all instances of '%s' are terminated",
+			*idleGroup.AutoScalingGroupName)
+	}
+
+	plan.addAutoScaling(&idleGroup,
+		runningGroup.DesiredCapacity,
+		runningGroup.MinSize,
+		runningGroup.MaxSize)
+	plan.addHooks(d.config.Hooks, HookAfterScaleUp)
+	plan.add(PlanActionWait, string(idle.Type), "health check until %d targets are healthy",
+		*runningGroup.DesiredCapacity)
+	if requests := len(d.config.SmokeTest.Requests); requests > 0 {
+		plan.add(PlanActionSmokeTest, string(idle.Type), "send %d requests to each healthy target", requests)
+	}
+	plan.addHooks(d.config.Hooks, HookAfterHealthCheck)
+
+	cleanupGroup := &idleGroup
+	if swap {
+		blue, green := idle, running
+		if green.Type == BlueTargetType {
+			blue, green = running, idle
+		}
+		plan.addHooks(d.config.Hooks, HookBeforeSwap)
+		if err := d.planSwapTraffic(plan, blue, green, steps); err != nil {
+			return nil, err
+		}
+		plan.addHooks(d.config.Hooks, HookAfterSwap)
+		cleanupGroup = &runningGroup
+	}
+
+	if cleanupAfterDeploy {
+		plan.addAutoScaling(cleanupGroup, nil, aws.Int32(0), nil)
+		plan.addHooks(d.config.Hooks, HookAfterCleanup)
+	}
+
+	return plan, nil
+}
+
+func (d *Deployer) PlanSwapTraffic(ctx context.Context, steps TrafficSteps) (*Plan, error) {
+	plan := newPlan("ec2 swap")
+
+	blue, green, err := d.getTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.planSwapTraffic(plan, blue, green, steps); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (d *Deployer) PlanUpdateTraffic(ctx context.Context, blueWeight int32, greenWeight int32) (*Plan, error) {
+	plan := newPlan("ec2 traffic")
+
+	blue, green, err := d.getTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan.addTraffic(*blue.TargetGroup.Weight, *green.TargetGroup.Weight, blueWeight, greenWeight)
+
+	return plan, nil
+}
+
+func (d *Deployer) PlanUpdateAutoScalingGroupByTarget(
+	ctx context.Context, targetType TargetType, desiredCapacity *int32, minSize *int32, maxSize *int32) (*Plan, error) {
+
+	plan := newPlan("ec2 autoscaling")
+
+	rule, err := d.client.GetALBListenerRule(ctx, d.config.ListenerRuleArn)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := d.GetDeployTarget(ctx, rule, targetType)
+	if err != nil {
+		return nil, err
+	}
+	group := *target.AutoScalingGroup
+	plan.addAutoScaling(&group, desiredCapacity, minSize, maxSize)
+
+	return plan, nil
+}
+
+func (d *Deployer) PlanCleanupAutoScalingGroup(ctx context.Context, autoScalingGroupName string) (*Plan, error) {
+	plan := newPlan("ec2 cleanup")
+
+	autoScalingGroup, err := d.client.DescribeAutoScalingGroup(ctx, autoScalingGroupName)
+	if err != nil {
+		return nil, err
+	}
+	group := *autoScalingGroup
+	plan.addAutoScaling(&group, aws.Int32(0), aws.Int32(0), nil)
+	plan.add(PlanActionWait, autoScalingGroupName, "until all instances of '%s' are terminated", autoScalingGroupName)
+
+	return plan, nil
+}
+
+func (d *Deployer) PlanMoveScheduledActions(
+	ctx context.Context, fromAutoScalingGroupName string, toAutoScalingGroupName string) (*Plan, error) {
+
+	plan := newPlan("ec2 move-scheduled-actions")
+
+	fromActions, err := describeScheduledActions(ctx, d.client, fromAutoScalingGroupName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, from := range fromActions {
+		var schedule []string
+		if from.Recurrence != nil {
+			schedule = append(schedule, "recurrence:'"+*from.Recurrence+"'")
+		}
+		if from.DesiredCapacity != nil {
+			schedule = append(schedule, fmt.Sprintf("desired:%d", *from.DesiredCapacity))
+		}
+		if from.MinSize != nil {
+			schedule = append(schedule, fmt.Sprintf("min:%d", *from.MinSize))
+		}
+		if from.MaxSize != nil {
+			schedule = append(schedule, fmt.Sprintf("max:%d", *from.MaxSize))
+		}
+		plan.add(PlanActionScheduledAction, toAutoScalingGroupName, "put '%s' (%s)",
+			*from.ScheduledActionName, strings.Join(schedule, ", "))
+		plan.add(PlanActionScheduledAction, fromAutoScalingGroupName, "delete '%s'", *from.ScheduledActionName)
+	}
+
+	return plan, nil
+}
@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"context"
+	"math"
+	"math/rand/v2"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,8 +18,30 @@ const (
 	ContinueRetry = false
 )
 
+const (
+	RetryTypeFixed       = "fixed"
+	RetryTypeExponential = "exponential"
+	RetryTypeJitter      = "jitter"
+	RetryTypeDeadline    = "deadline"
+)
+
 type Retryer interface {
-	Start(hendler func(index int, interval *time.Duration) (RetryResult, error)) error
+	Start(ctx context.Context, hendler func(index int, interval *time.Duration) (RetryResult, error)) error
+}
+
+// NewRetryer Returns the retryer of the strategy.
+func NewRetryer(strategy *RetryStrategy) Retryer {
+	interval := time.Duration(strategy.IntervalSeconds) * time.Second
+	maxInterval := time.Duration(strategy.MaxIntervalSeconds) * time.Second
+	switch strategy.Type {
+	case RetryTypeExponential:
+		return NewExponentialRetryer(strategy.MaxLimit, interval, maxInterval, strategy.Multiplier, false)
+	case RetryTypeJitter:
+		return NewExponentialRetryer(strategy.MaxLimit, interval, maxInterval, strategy.Multiplier, true)
+	case RetryTypeDeadline:
+		return NewDeadlineRetryer(time.Duration(strategy.TimeoutSeconds)*time.Second, &interval)
+	}
+	return NewFixedIntervalRetryer(strategy.MaxLimit, &interval)
 }
 
 type FixedIntervalRetryer struct {
@@ -31,7 +56,7 @@ func NewFixedIntervalRetryer(maxLimit int, interval *time.Duration) *FixedInterv
 	}
 }
 
-func (r FixedIntervalRetryer) Start(hendler func(index int, interval *time.Duration) (RetryResult, error)) error {
+func (r FixedIntervalRetryer) Start(ctx context.Context, hendler func(index int, interval *time.Duration) (RetryResult, error)) error {
 	for i := 0; i < r.maxLimit; i++ {
 		result, err := hendler(i, r.interval)
 		if err != nil {
@@ -43,8 +68,115 @@ func (r FixedIntervalRetryer) Start(hendler func(index int, interval *time.Durat
 			return nil
 		}
 
-		time.Sleep(*r.interval)
+		if err := sleep(ctx, *r.interval); err != nil {
+			return err
+		}
 	}
 
 	return RetryTimeout
 }
+
+// ExponentialRetryer Multiply the interval by the multiplier on every retry up to maxInterval.
+// With jitter, each wait is a random duration between 0 and the interval, so that concurrent callers do not retry at once.
+type ExponentialRetryer struct {
+	maxLimit    int
+	interval    time.Duration
+	maxInterval time.Duration
+	multiplier  float64
+	jitter      bool
+}
+
+func NewExponentialRetryer(maxLimit int, interval time.Duration, maxInterval time.Duration, multiplier float64, jitter bool) *ExponentialRetryer {
+	return &ExponentialRetryer{
+		maxLimit:    maxLimit,
+		interval:    interval,
+		maxInterval: maxInterval,
+		multiplier:  multiplier,
+		jitter:      jitter,
+	}
+}
+
+// Interval Returns the interval after the index-th attempt.
+func (r ExponentialRetryer) Interval(index int) time.Duration {
+	interval := time.Duration(float64(r.interval) * math.Pow(r.multiplier, float64(index)))
+	if interval > r.maxInterval || interval <= 0 {
+		interval = r.maxInterval
+	}
+	if r.jitter && interval > 0 {
+		interval = rand.N(interval + 1)
+	}
+	return interval
+}
+
+func (r ExponentialRetryer) Start(ctx context.Context, hendler func(index int, interval *time.Duration) (RetryResult, error)) error {
+	for i := 0; i < r.maxLimit; i++ {
+		interval := r.Interval(i)
+		result, err := hendler(i, &interval)
+		if err != nil {
+			return errors.Wrapf(err, "RetryFailure")
+		}
+
+		//lint:ignore S1002 To make it easier to understand
+		if result == FinishRetry {
+			return nil
+		}
+
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+
+	return RetryTimeout
+}
+
+// DeadlineRetryer Retry at the interval until the timeout has elapsed, instead of a number of times.
+type DeadlineRetryer struct {
+	timeout  time.Duration
+	interval *time.Duration
+}
+
+func NewDeadlineRetryer(timeout time.Duration, interval *time.Duration) *DeadlineRetryer {
+	return &DeadlineRetryer{
+		timeout:  timeout,
+		interval: interval,
+	}
+}
+
+func (r DeadlineRetryer) Start(ctx context.Context, hendler func(index int, interval *time.Duration) (RetryResult, error)) error {
+	deadline := time.Now().Add(r.timeout)
+	for i := 0; ; i++ {
+		result, err := hendler(i, r.interval)
+		if err != nil {
+			return errors.Wrapf(err, "RetryFailure")
+		}
+
+		//lint:ignore S1002 To make it easier to understand
+		if result == FinishRetry {
+			return nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return RetryTimeout
+		}
+		if wait > *r.interval {
+			wait = *r.interval
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep Wait for the duration. Returns the error of the context as soon as it is cancelled.
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+)
+
+// SignatureSuffix Suffix of the detached signature of the bundle. It is the base64 ed25519 signature of the SHA-256 digest of the bundle.
+const SignatureSuffix string = ".sig"
+
+var SignatureError = errors.New("SignatureError")
+
+// LoadSigningKey Read the ed25519 private key in the PKCS#8 PEM, e.g. generated by 'openssl genpkey -algorithm ed25519'.
+func LoadSigningKey(filepath string) (ed25519.PrivateKey, error) {
+	raw, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.Errorf("'%s' is not a PEM file.", filepath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid private key. file:%s", filepath)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("The private key must be ed25519. file:%s", filepath)
+	}
+	return privateKey, nil
+}
+
+// parsePublicKey Parse the ed25519 public key in the PKIX PEM, given inline or as the file path.
+func parsePublicKey(value string) (ed25519.PublicKey, error) {
+	raw := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		file, err := os.ReadFile(value)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		raw = file
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("The public key of signaturePublicKeys is not a PEM.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid public key of signaturePublicKeys.")
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("The public key of signaturePublicKeys must be ed25519.")
+	}
+	return publicKey, nil
+}
+
+func signChecksum(privateKey ed25519.PrivateKey, checksum string) (string, error) {
+	digest, err := hex.DecodeString(checksum)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, digest)) + "\n", nil
+}
+
+// getSignature Returns the signature of the bundle, or nil if the bundle is not signed.
+func (b *Bundler) getSignature(ctx context.Context, key string) ([]byte, error) {
+	output, err := b.client.GetS3BucketObject(ctx, b.config.BundleBucket, key+SignatureSuffix)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(output.Body); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(buf.String()))
+	if err != nil {
+		return nil, errors.Wrapf(SignatureError, "The signature of '%s' is not base64. %s", key, err)
+	}
+	return signature, nil
+}
+
+// verifySignature Verify the signature of the bundle over the checksum with signaturePublicKeys of the config.
+// Returns SignatureError if the signature is invalid, or if it is missing while requireSignature is set.
+// Without signaturePublicKeys, nothing is verified.
+func (b *Bundler) verifySignature(ctx context.Context, key string, checksum string) error {
+	if len(b.config.SignaturePublicKeys) == 0 {
+		return nil
+	}
+
+	signature, err := b.getSignature(ctx, key)
+	if err != nil {
+		return err
+	}
+	if signature == nil {
+		if b.config.RequireSignature {
+			return errors.Wrapf(SignatureError, "'%s' is not signed. Register it with --sign-key.", key)
+		}
+		b.logger.Warn(fmt.Sprintf("'%s' is not signed, so the signature is not verified.", key), nil)
+		return nil
+	}
+	if checksum == "" {
+		return errors.Wrapf(SignatureError, "'%s' has no checksum to verify the signature with. Register it again.", key)
+	}
+	digest, err := hex.DecodeString(checksum)
+	if err != nil {
+		return errors.Wrapf(SignatureError, "Invalid checksum of '%s'. %s", key, err)
+	}
+
+	for _, value := range b.config.SignaturePublicKeys {
+		publicKey, err := parsePublicKey(value)
+		if err != nil {
+			return err
+		}
+		if ed25519.Verify(publicKey, digest, signature) {
+			b.logger.Info(fmt.Sprintf("The signature of '%s' verified.", key))
+			return nil
+		}
+	}
+	return errors.Wrapf(SignatureError, "The signature of '%s' does not match any of signaturePublicKeys.", key)
+}
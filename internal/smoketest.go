@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/pkg/errors"
+)
+
+var SmokeTestError = errors.New("SmokeTestError")
+
+// SmokeTest Send the requests of the smokeTest config to every healthy target of the target group.
+// The instance targets, which the AutoScalingGroup registers, are sent to the private IP address of the instance.
+// Returns SmokeTestError as soon as a response does not meet the expectation.
+func (d *Deployer) SmokeTest(ctx context.Context, targetGroupArn string) error {
+	config := d.config.SmokeTest
+	if len(config.Requests) == 0 {
+		return nil
+	}
+
+	patterns := make([]*regexp.Regexp, len(config.Requests))
+	for i, request := range config.Requests {
+		if request.BodyPattern == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(request.BodyPattern)
+		if err != nil {
+			return errors.Wrapf(SmokeTestError, "Invalid bodyPattern of smoke test. path:%s, %s", request.Path, err)
+		}
+		patterns[i] = pattern
+	}
+
+	health, err := d.client.DescribeALBTargetHealth(ctx, targetGroupArn)
+	if err != nil {
+		return err
+	}
+	targets := Filter(health, func(h *albTypes.TargetHealthDescription) bool {
+		return h.TargetHealth.State == albTypes.TargetHealthStateEnumHealthy
+	})
+	if len(targets) == 0 {
+		return errors.Wrap(SmokeTestError, "There are no healthy targets to test.")
+	}
+
+	addresses, err := d.targetAddresses(ctx, targetGroupArn, targets)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: time.Duration(config.TimeoutSeconds) * time.Second}
+	for _, target := range targets {
+		port := config.Port
+		if port == 0 && target.Target.Port != nil {
+			port = *target.Target.Port
+		}
+		host := net.JoinHostPort(addresses[*target.Target.Id], strconv.Itoa(int(port)))
+
+		for i, request := range config.Requests {
+			url := fmt.Sprintf("%s://%s%s", config.Scheme, host, request.Path)
+			if err := request.send(ctx, client, url, patterns[i]); err != nil {
+				return err
+			}
+			d.logger.Info(fmt.Sprintf("Smoke test passed. %s %s", request.method(), url))
+		}
+	}
+
+	return nil
+}
+
+// targetAddresses Returns the address of each target ID. The ID is the address itself if the target group is registered by IP address,
+// and the instance ID otherwise, which is resolved to the private IP address of the instance.
+func (d *Deployer) targetAddresses(ctx context.Context, targetGroupArn string, targets []albTypes.TargetHealthDescription) (map[string]string, error) {
+	targetGroup, err := d.client.DescribeALBTargetGroup(ctx, targetGroupArn)
+	if err != nil {
+		return nil, err
+	}
+	ids := Map(targets, func(_ int, t *albTypes.TargetHealthDescription) *string { return t.Target.Id })
+
+	addresses := map[string]string{}
+	switch targetGroup.TargetType {
+	case albTypes.TargetTypeEnumIp:
+		for _, id := range ids {
+			addresses[id] = id
+		}
+	case albTypes.TargetTypeEnumInstance, "":
+		instances, err := d.client.DescribeEC2Instances(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			if instance.InstanceId != nil && instance.PrivateIpAddress != nil {
+				addresses[*instance.InstanceId] = *instance.PrivateIpAddress
+			}
+		}
+		for _, id := range ids {
+			if addresses[id] == "" {
+				return nil, errors.Wrapf(SmokeTestError, "The private IP address of the instance is not found. instanceId:%s", id)
+			}
+		}
+	default:
+		return nil, errors.Wrapf(SmokeTestError, "The target type '%s' of the target group is not supported.", targetGroup.TargetType)
+	}
+	return addresses, nil
+}
+
+func (r *SmokeTestRequest) method() string {
+	if r.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(r.Method)
+}
+
+func (r *SmokeTestRequest) send(ctx context.Context, client *http.Client, url string, pattern *regexp.Regexp) error {
+	req, err := http.NewRequestWithContext(ctx, r.method(), url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for key, value := range r.Headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(SmokeTestError, "%s %s, %s", r.method(), url, err)
+	}
+	defer res.Body.Close()
+
+	expectedStatus := r.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if res.StatusCode != expectedStatus {
+		return errors.Wrapf(SmokeTestError, "%s %s, status:%d, expected:%d", r.method(), url, res.StatusCode, expectedStatus)
+	}
+
+	if pattern != nil {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return errors.Wrapf(SmokeTestError, "%s %s, %s", r.method(), url, err)
+		}
+		if !pattern.Match(body) {
+			return errors.Wrapf(SmokeTestError, "%s %s, the body does not match '%s'", r.method(), url, pattern)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const MaxTrafficWeight int32 = 100
+
+// TrafficStep Percentage of traffic routed to the new target and the time to wait (bake) before the next step.
+type TrafficStep struct {
+	Weight   int32         `json:"weight"`
+	BakeTime time.Duration `json:"bakeTime"`
+}
+
+func (s *TrafficStep) IsFinal() bool {
+	return s.Weight >= MaxTrafficWeight
+}
+
+type TrafficSteps []TrafficStep
+
+// NewTrafficSteps Parse a step definition such as '10,25,50,100' or '10:30s,50:2m,100'.
+// Steps without an explicit bake time wait for bakeTime. If spec is empty, the traffic is
+// distributed 50:50 when bakeTime is greater than 0, and then completely swapped.
+func NewTrafficSteps(spec string, bakeTime time.Duration) (TrafficSteps, error) {
+	if strings.TrimSpace(spec) == "" {
+		if bakeTime > 0 {
+			return TrafficSteps{{Weight: 50, BakeTime: bakeTime}, {Weight: MaxTrafficWeight}}, nil
+		}
+		return TrafficSteps{{Weight: MaxTrafficWeight}}, nil
+	}
+
+	var steps TrafficSteps
+	for _, part := range strings.Split(spec, ",") {
+		weightPart, bakePart, hasBake := strings.Cut(strings.TrimSpace(part), ":")
+		weight, err := strconv.ParseInt(weightPart, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("Invalid traffic step '%s'. The weight must be an integer.", part)
+		}
+		if weight <= 0 || int32(weight) > MaxTrafficWeight {
+			return nil, errors.Errorf("Invalid traffic step '%s'. The weight must be between 1 and %d.", part, MaxTrafficWeight)
+		}
+		if len(steps) > 0 && int32(weight) <= steps[len(steps)-1].Weight {
+			return nil, errors.Errorf("Invalid traffic step '%s'. The weights must be in ascending order.", part)
+		}
+
+		step := TrafficStep{Weight: int32(weight), BakeTime: bakeTime}
+		if hasBake {
+			step.BakeTime, err = time.ParseDuration(bakePart)
+			if err != nil {
+				return nil, errors.Errorf("Invalid traffic step '%s'. The bake time must be a duration such as '60s'.", part)
+			}
+		}
+		steps = append(steps, step)
+	}
+
+	if !steps[len(steps)-1].IsFinal() {
+		return nil, errors.Errorf("Invalid traffic steps '%s'. The last step must be %d.", spec, MaxTrafficWeight)
+	}
+	steps[len(steps)-1].BakeTime = 0
+
+	return steps, nil
+}
+
+func (s TrafficSteps) String() string {
+	var parts []string
+	for _, step := range s {
+		if step.BakeTime > 0 {
+			parts = append(parts, fmt.Sprintf("%d%%(%s)", step.Weight, step.BakeTime))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d%%", step.Weight))
+		}
+	}
+	return strings.Join(parts, " -> ")
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TransferPartSize Part size of the multipart upload and the ranged download of bundles.
+	// The memory used for a transfer is about TransferPartSize * TransferConcurrency regardless of the bundle size.
+	TransferPartSize int64 = 16 * 1024 * 1024
+	// TransferConcurrency Number of the parts transferred at the same time.
+	TransferConcurrency = 5
+)
+
+// progress Shows the progress of a transfer on stderr. It is redrawn in place on a terminal,
+// and printed every 10% otherwise so as not to flood the logs of CI.
+type progress struct {
+	label    string
+	total    int64
+	done     atomic.Int64
+	w        io.Writer
+	terminal bool
+	mu       sync.Mutex
+	drawnAt  time.Time
+	step     int64
+}
+
+func newProgress(label string, total int64) *progress {
+	terminal := false
+	if info, err := os.Stderr.Stat(); err == nil {
+		terminal = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &progress{label: label, total: total, w: os.Stderr, terminal: terminal, step: -1}
+}
+
+// add The parts are transferred concurrently, so it is called from multiple goroutines.
+func (p *progress) add(n int) {
+	done := p.done.Add(int64(n))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw(done, false)
+}
+
+// finish Draw the last state and end the line. It is called even if the transfer failed.
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw(p.done.Load(), true)
+}
+
+func (p *progress) draw(done int64, final bool) {
+	// a retried part is read again, so the done can exceed the total
+	done = min(done, p.total)
+	percent := int64(100)
+	if p.total > 0 {
+		percent = done * 100 / p.total
+	}
+
+	if !p.terminal {
+		if step := percent / 10; step > p.step {
+			p.step = step
+			fmt.Fprintf(p.w, "%s %3d%% %s / %s\n", p.label, percent, formatBytes(done), formatBytes(p.total))
+		}
+		return
+	}
+	if !final && time.Since(p.drawnAt) < 100*time.Millisecond {
+		return
+	}
+	p.drawnAt = time.Now()
+	const width = 30
+	filled := int(percent) * width / 100
+	fmt.Fprintf(p.w, "\r%s [%s%s] %3d%% %s / %s", p.label, strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+		percent, formatBytes(done), formatBytes(p.total))
+	if final {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressReader Counts the bytes read from the file. ReadAt and Seek are kept,
+// so that the uploader reads the parts from the file concurrently instead of buffering them.
+type progressReader struct {
+	file     *os.File
+	progress *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.file.Read(b)
+	r.progress.add(n)
+	return n, err
+}
+
+func (r *progressReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.file.ReadAt(b, off)
+	r.progress.add(n)
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	return r.file.Seek(offset, whence)
+}
+
+// progressWriter Counts the bytes written to the file. The parts of the download are written at their offsets in any order.
+type progressWriter struct {
+	file     *os.File
+	progress *progress
+}
+
+func (w *progressWriter) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.file.WriteAt(b, off)
+	w.progress.add(n)
+	return n, err
+}
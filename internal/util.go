@@ -103,6 +103,23 @@ func FastDelete[T any](items []T, cond func(*T) bool) []T {
 	return items
 }
 
+// Paginate Call the page function with the token of the previous page until there is no next page, and returns all the items.
+func Paginate[T any](page func(token *string) ([]T, *string, error)) ([]T, error) {
+	var items []T
+	var token *string
+	for {
+		pageItems, next, err := page(token)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, pageItems...)
+		if next == nil || *next == "" {
+			return items, nil
+		}
+		token = next
+	}
+}
+
 func GetEnv(key string, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
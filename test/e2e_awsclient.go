@@ -3,18 +3,24 @@ package test
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 	"github.com/givery-technology/deployman/internal"
 	"github.com/pkg/errors"
 )
@@ -27,23 +33,53 @@ func NewMockAwsClient(state *TestingState) *MockAwsClient {
 	return &MockAwsClient{State: state}
 }
 
+// MockPageSize Every list API returns up to this number of items per page, so that the pagination is always exercised.
+const MockPageSize = 10
+
+// MockPartSize Part size of the mock transfers, small enough that a test bundle is split into several parts.
+const MockPartSize = 1024 * 1024
+
+// page Returns the items of the page starting at the token, and the token of the next page if any.
+func page[T any](items []T, token *string) ([]T, *string, error) {
+	start := 0
+	if token != nil {
+		var err error
+		if start, err = strconv.Atoi(*token); err != nil || start > len(items) {
+			return nil, nil, errors.Errorf("Invalid pagination token. token:%s", *token)
+		}
+	}
+	end := start + MockPageSize
+	if end >= len(items) {
+		return items[start:], nil, nil
+	}
+	return items[start:end], aws.String(strconv.Itoa(end)), nil
+}
+
+func newETag(value []byte) *string {
+	return aws.String(fmt.Sprintf("\"%x\"", md5.Sum(value)))
+}
+
 func (c *MockAwsClient) Region() string {
 	return "us-east-1"
 }
 
-func (c *MockAwsClient) ListS3BucketObjects(_ context.Context, bucket string, prefix string) ([]s3Types.Object, error) {
+func (c *MockAwsClient) ListS3BucketObjects(_ context.Context, bucket string, prefix string, continuationToken *string) ([]s3Types.Object, *string, error) {
 	var objects []TestingBucketObject
 	if c.State.Bucket != nil && *c.State.Bucket.Name == bucket {
 		objects = internal.Filter(c.State.Bucket.Objects, func(o *TestingBucketObject) bool {
 			return strings.Contains(*o.Key, prefix)
 		})
 	}
+	objects, next, err := page(objects, continuationToken)
+	if err != nil {
+		return nil, nil, err
+	}
 	return internal.Map(objects, func(_ int, o *TestingBucketObject) *s3Types.Object {
 		return &s3Types.Object{
 			Key:          aws.String(*o.Key),
 			LastModified: o.LastModified,
 		}
-	}), nil
+	}), next, nil
 }
 
 func (c *MockAwsClient) HeadS3Bucket(_ context.Context, bucket string) error {
@@ -92,23 +128,44 @@ func (c *MockAwsClient) DisableS3BucketPublicAccess(_ context.Context, bucket st
 }
 
 func (c *MockAwsClient) DeleteS3BucketObject(_ context.Context, bucket string, key string) error {
-	var objects []TestingBucketObject
 	if c.State.Bucket != nil && *c.State.Bucket.Name == bucket {
-		objects = internal.Filter(c.State.Bucket.Objects, func(o *TestingBucketObject) bool {
-			return strings.Contains(*o.Key, key)
+		c.State.Bucket.Objects = internal.FastDelete(c.State.Bucket.Objects, func(o *TestingBucketObject) bool {
+			return *o.Key == key
 		})
 	}
-	c.State.Bucket.Objects = internal.FastDelete(objects, func(o *TestingBucketObject) bool {
+	return nil
+}
+
+func (c *MockAwsClient) DeleteS3BucketObjectIfMatch(_ context.Context, bucket string, key string, etag string) error {
+	object := c.State.FindBucketObject(bucket, key)
+	if object == nil || *object.ETag != etag {
+		return &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	c.State.Bucket.Objects = internal.FastDelete(c.State.Bucket.Objects, func(o *TestingBucketObject) bool {
 		return *o.Key == key
 	})
 	return nil
 }
 
-func (c *MockAwsClient) PutS3BucketObjectAsBinaryFile(_ context.Context, bucket string, key string, file *os.File) error {
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-	buf, err := io.ReadAll(file)
+// UploadS3BucketObject Reads the body in MockPartSize parts concurrently as the multipart upload does.
+// The body must be io.ReaderAt and io.Seeker, otherwise the real uploader buffers the parts in memory.
+func (c *MockAwsClient) UploadS3BucketObject(_ context.Context, bucket string, key string, body io.Reader, metadata map[string]string) error {
+	file, ok := body.(interface {
+		io.ReaderAt
+		io.Seeker
+	})
+	if !ok {
+		return errors.Errorf("The body is buffered by the uploader. type:%T", body)
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf := make([]byte, size)
+	parts, err := transferParts(size, func(off int64, end int64) error {
+		_, err := file.ReadAt(buf[off:end], off)
+		return err
+	})
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -117,37 +174,131 @@ func (c *MockAwsClient) PutS3BucketObjectAsBinaryFile(_ context.Context, bucket
 			LastModified: aws.Time(time.Now()),
 			Key:          aws.String(key),
 			Value:        buf,
+			ETag:         newETag(buf),
+			Metadata:     metadata,
+			Parts:        parts,
 		})
 	}
 	return nil
 }
 
+// DownloadS3BucketObject Writes the object in MockPartSize ranges concurrently as the ranged download does.
+func (c *MockAwsClient) DownloadS3BucketObject(_ context.Context, bucket string, key string, etag string, w io.WriterAt) (int64, error) {
+	output, err := c.GetS3BucketObject(context.TODO(), bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	if *output.ETag != etag {
+		return 0, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	object := c.State.FindLatestBucketObject(bucket, key)
+	object.Parts, err = transferParts(int64(len(object.Value)), func(off int64, end int64) error {
+		_, err := w.WriteAt(object.Value[off:end], off)
+		return err
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return int64(len(object.Value)), nil
+}
+
+// transferParts Run the transfer of every part at the same time, and returns the number of the parts.
+func transferParts(size int64, transfer func(off int64, end int64) error) (int, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	parts := 0
+	for off := int64(0); off < size; off += MockPartSize {
+		parts++
+		wg.Add(1)
+		go func(off int64, end int64) {
+			defer wg.Done()
+			if err := transfer(off, end); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(off, min(off+MockPartSize, size))
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return 0, errs[0]
+	}
+	return parts, nil
+}
+
 func (c *MockAwsClient) PutS3BucketObjectAsTextFile(_ context.Context, bucket string, key string, value string) error {
+	if object := c.State.FindBucketObject(bucket, key); object != nil {
+		object.LastModified = aws.Time(time.Now())
+		object.Value = []byte(value)
+		object.ETag = newETag([]byte(value))
+		return nil
+	}
 	if c.State.Bucket != nil {
 		c.State.Bucket.Objects = append(c.State.Bucket.Objects, TestingBucketObject{
 			LastModified: aws.Time(time.Now()),
 			Key:          aws.String(key),
 			Value:        []byte(value),
 			ContentType:  aws.String("text/plain"),
+			ETag:         newETag([]byte(value)),
 		})
 	}
 	return nil
 }
 
+func (c *MockAwsClient) PutS3BucketObjectAsTextFileIfNotExists(_ context.Context, bucket string, key string, value string) error {
+	if c.State.Bucket == nil || *c.State.Bucket.Name != bucket {
+		return &s3Types.NoSuchBucket{Message: aws.String("The specified bucket does not exist")}
+	}
+	if c.State.FindBucketObject(bucket, key) != nil {
+		return &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	c.State.Bucket.Objects = append(c.State.Bucket.Objects, TestingBucketObject{
+		LastModified: aws.Time(time.Now()),
+		Key:          aws.String(key),
+		Value:        []byte(value),
+		ContentType:  aws.String("text/plain"),
+		ETag:         newETag([]byte(value)),
+	})
+	return nil
+}
+
+func (c *MockAwsClient) PutS3BucketObjectAsTextFileIfMatch(_ context.Context, bucket string, key string, value string, etag string) error {
+	object := c.State.FindBucketObject(bucket, key)
+	if object == nil || *object.ETag != etag {
+		return &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	object.LastModified = aws.Time(time.Now())
+	object.Value = []byte(value)
+	object.ETag = newETag([]byte(value))
+	return nil
+}
+
 func (c *MockAwsClient) GetS3BucketObject(_ context.Context, bucket string, key string) (*s3.GetObjectOutput, error) {
-	if c.State.Bucket != nil && *c.State.Bucket.Name == bucket {
-		object := internal.FirstOrNil(c.State.Bucket.Objects, func(o *TestingBucketObject) bool {
-			return strings.Contains(*o.Key, key)
-		})
-		if object != nil {
-			output := &s3.GetObjectOutput{
-				LastModified: aws.Time(time.Now()),
-				Body:         io.NopCloser(bytes.NewReader(object.Value)),
-			}
-			return output, nil
+	if object := c.State.FindLatestBucketObject(bucket, key); object != nil {
+		output := &s3.GetObjectOutput{
+			LastModified:  aws.Time(time.Now()),
+			Body:          io.NopCloser(bytes.NewReader(object.Value)),
+			ContentLength: aws.Int64(int64(len(object.Value))),
+			ETag:          object.ETag,
+			Metadata:      object.Metadata,
 		}
+		return output, nil
+	}
+	return nil, &s3Types.NoSuchKey{Message: aws.String(fmt.Sprintf("Bucket object not found. bucket:%s, key:%s", bucket, key))}
+}
+
+func (c *MockAwsClient) HeadS3BucketObject(_ context.Context, bucket string, key string) (*s3.HeadObjectOutput, error) {
+	output, err := c.GetS3BucketObject(context.TODO(), bucket, key)
+	if err != nil {
+		return nil, &s3Types.NotFound{Message: aws.String(fmt.Sprintf("Bucket object not found. bucket:%s, key:%s", bucket, key))}
 	}
-	return nil, errors.Errorf("Bucket object not found. bucket:%s, key:%s", bucket, key)
+	return &s3.HeadObjectOutput{
+		LastModified:  output.LastModified,
+		ContentLength: output.ContentLength,
+		ETag:          output.ETag,
+		Metadata:      output.Metadata,
+	}, nil
 }
 
 func (c *MockAwsClient) GetALBListenerRule(_ context.Context, listenerRuleArn string) (*albTypes.Rule, error) {
@@ -176,14 +327,28 @@ func (c *MockAwsClient) GetALBListenerRule(_ context.Context, listenerRuleArn st
 }
 
 func (c *MockAwsClient) DescribeALBTargetHealth(_ context.Context, targetGroupArn string) ([]albTypes.TargetHealthDescription, error) {
+	if c.State.throttled("DescribeTargetHealth") {
+		return nil, &smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"}
+	}
+	if c.State.failed("DescribeTargetHealth") {
+		return nil, &smithy.GenericAPIError{Code: "ServiceUnavailable", Message: "Service is unavailable"}
+	}
 	targetGroup := internal.FirstOrNil(c.State.LoadBalancer.TargetGroups, func(tg *TestingTargetGroup) bool {
 		return *tg.TargetGroupArn == targetGroupArn
 	})
 	if targetGroup == nil {
 		return nil, errors.Errorf("TargetHealth not found. targetGruopArn:%s", targetGroupArn)
 	}
-	return internal.Map(targetGroup.HealthStates, func(_ int, state *albTypes.TargetHealthStateEnum) *albTypes.TargetHealthDescription {
+	return internal.Map(targetGroup.HealthStates, func(i int, state *albTypes.TargetHealthStateEnum) *albTypes.TargetHealthDescription {
+		id := aws.String(targetInstanceId(targetGroup, i))
+		if targetGroup.TargetType == albTypes.TargetTypeEnumIp {
+			id = targetGroup.TargetAddress
+		}
 		return &albTypes.TargetHealthDescription{
+			Target: &albTypes.TargetDescription{
+				Id:   id,
+				Port: targetGroup.TargetPort,
+			},
 			TargetHealth: &albTypes.TargetHealth{
 				State: *state,
 			},
@@ -198,7 +363,16 @@ func (c *MockAwsClient) DescribeAutoScalingGroup(_ context.Context, name string)
 	if autoScalingGroup == nil {
 		return nil, errors.Errorf("AutoScalingGroup not found. name:%s", name)
 	}
-	return autoScalingGroup.AutoScalingGroup, nil
+	// a snapshot, as the real API returns
+	snapshot := *autoScalingGroup.AutoScalingGroup
+	return &snapshot, nil
+}
+
+func (c *MockAwsClient) ListAutoScalingGroups(_ context.Context, nextToken *string) ([]asgTypes.AutoScalingGroup, *string, error) {
+	groups := internal.Map(c.State.AutoScalingGroups, func(_ int, g *TestingAutoScalingGroup) *asgTypes.AutoScalingGroup {
+		return g.AutoScalingGroup
+	})
+	return page(groups, nextToken)
 }
 
 func (c *MockAwsClient) DescribeALBTargetGroup(_ context.Context, targetGroupArn string) (*albTypes.TargetGroup, error) {
@@ -208,12 +382,21 @@ func (c *MockAwsClient) DescribeALBTargetGroup(_ context.Context, targetGroupArn
 	if targetGroup == nil {
 		return nil, errors.Errorf("TargetGroup not found. listenerRuleArn:%s", targetGroupArn)
 	}
+	targetType := targetGroup.TargetType
+	if targetType == "" {
+		targetType = albTypes.TargetTypeEnumInstance
+	}
 	return &albTypes.TargetGroup{
-		TargetGroupName: targetGroup.TargetGroupName,
+		TargetGroupName:  targetGroup.TargetGroupName,
+		TargetType:       targetType,
+		LoadBalancerArns: []string{"arn:aws:elasticloadbalancing:::loadbalancer/app/test-alb/99999999"},
 	}, nil
 }
 
 func (c *MockAwsClient) ModifyALBListenerRule(_ context.Context, listenerRuleArn string, forwardAction *albTypes.ForwardActionConfig) error {
+	if c.State.failed("ModifyRule") {
+		return &smithy.GenericAPIError{Code: "ServiceUnavailable", Message: "Service is unavailable"}
+	}
 	if *c.State.LoadBalancer.ListenerRuleArn != listenerRuleArn {
 		return errors.Errorf("ListenerRule not found. listenerRuleArn:%s", listenerRuleArn)
 	}
@@ -250,19 +433,23 @@ func (c *MockAwsClient) UpdateAutoScalingGroup(_ context.Context, name string, d
 			if maxSize != nil {
 				autoScalingGroup.MaxSize = maxSize
 			}
+			// scale-in terminates instances immediately
+			if desired := int(*autoScalingGroup.DesiredCapacity); len(autoScalingGroup.Instances) > desired {
+				autoScalingGroup.Instances = autoScalingGroup.Instances[:desired]
+			}
 		}
 	}
 	return nil
 }
 
-func (c *MockAwsClient) DescribeScheduledActions(_ context.Context, name string) ([]asgTypes.ScheduledUpdateGroupAction, error) {
+func (c *MockAwsClient) DescribeScheduledActions(_ context.Context, name string, nextToken *string) ([]asgTypes.ScheduledUpdateGroupAction, *string, error) {
 	autoScalingGroup := internal.FirstOrNil(c.State.AutoScalingGroups, func(g *TestingAutoScalingGroup) bool {
 		return *g.AutoScalingGroupName == name
 	})
 	if autoScalingGroup == nil {
-		return nil, errors.Errorf("AutoScalingGroup not found. name:%s", name)
+		return nil, nil, errors.Errorf("AutoScalingGroup not found. name:%s", name)
 	}
-	return autoScalingGroup.ScheduledActions, nil
+	return page(autoScalingGroup.ScheduledActions, nextToken)
 }
 
 func (c *MockAwsClient) PutScheduledUpdateGroupAction(_ context.Context, name string, action *asgTypes.ScheduledUpdateGroupAction) error {
@@ -287,7 +474,32 @@ func (c *MockAwsClient) DeleteScheduledAction(_ context.Context, autoScalingGrou
 	return nil
 }
 
+func (c *MockAwsClient) DescribeEC2Instances(_ context.Context, instanceIds []string) ([]ec2Types.Instance, error) {
+	instances := make([]ec2Types.Instance, 0, len(instanceIds))
+	for _, id := range instanceIds {
+		address, ok := c.State.Instances[id]
+		if !ok {
+			return nil, &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: fmt.Sprintf("The instance ID '%s' does not exist", id)}
+		}
+		instances = append(instances, ec2Types.Instance{
+			InstanceId:       aws.String(id),
+			PrivateIpAddress: aws.String(address),
+		})
+	}
+	return instances, nil
+}
+
 func (c *MockAwsClient) GetSSMParameter(_ context.Context, name string, withDecription bool) (*ssmTypes.Parameter, error) {
+	if c.State != nil {
+		if value, ok := c.State.Parameters[name]; ok {
+			return &ssmTypes.Parameter{
+				LastModifiedDate: aws.Time(time.Now()),
+				Name:             aws.String(name),
+				Type:             ssmTypes.ParameterTypeString,
+				Value:            aws.String(value),
+			}, nil
+		}
+	}
 	return &ssmTypes.Parameter{
 		LastModifiedDate: aws.Time(time.Now()),
 		Name:             aws.String("test/parameter/001"),
@@ -296,3 +508,63 @@ func (c *MockAwsClient) GetSSMParameter(_ context.Context, name string, withDecr
 		Version:          0,
 	}, nil
 }
+
+func (c *MockAwsClient) PutSSMParameter(_ context.Context, name string, value string, overwrite bool) error {
+	if _, ok := c.State.Parameters[name]; ok && !overwrite {
+		return &ssmTypes.ParameterAlreadyExists{Message: aws.String("The parameter already exists.")}
+	}
+	c.State.WithParameter(name, value)
+	return nil
+}
+
+func (c *MockAwsClient) DescribeCloudWatchAlarms(_ context.Context, alarmNames []string, nextToken *string) (*cloudwatch.DescribeAlarmsOutput, error) {
+	if c.State.failed("DescribeAlarms") {
+		return nil, &smithy.GenericAPIError{Code: "ServiceUnavailable", Message: "Service is unavailable"}
+	}
+	var alarms []*TestingAlarm
+	for i := range c.State.Alarms {
+		if internal.Contains(alarmNames, c.State.Alarms[i].Name) {
+			alarms = append(alarms, &c.State.Alarms[i])
+		}
+	}
+	alarms, next, err := page(alarms, nextToken)
+	if err != nil {
+		return nil, err
+	}
+	output := &cloudwatch.DescribeAlarmsOutput{NextToken: next}
+	for _, alarm := range alarms {
+		output.MetricAlarms = append(output.MetricAlarms, cwTypes.MetricAlarm{
+			AlarmName:  alarm.Name,
+			StateValue: alarm.nextState(),
+		})
+	}
+	return output, nil
+}
+
+// GetCloudWatchMetricData The datapoints are of the consecutive periods from the start time, latest first as the real API returns.
+func (c *MockAwsClient) GetCloudWatchMetricData(_ context.Context, queries []cwTypes.MetricDataQuery, startTime time.Time, _ time.Time) ([]cwTypes.MetricDataResult, error) {
+	var results []cwTypes.MetricDataResult
+	for _, query := range queries {
+		dimension := internal.FirstOrNil(query.MetricStat.Metric.Dimensions, func(d *cwTypes.Dimension) bool {
+			return *d.Name == "TargetGroup"
+		})
+		targetGroup := internal.FirstOrNil(c.State.LoadBalancer.TargetGroups, func(tg *TestingTargetGroup) bool {
+			return dimension != nil && strings.HasSuffix(*tg.TargetGroupArn, ":"+*dimension.Value)
+		})
+		if targetGroup == nil {
+			return nil, errors.Errorf("TargetGroup not found. dimensions:%v", query.MetricStat.Metric.Dimensions)
+		}
+		// every datapoint is returned in its own result, as the pages of the API split the datapoints of a query
+		values := targetGroup.Metrics[*query.MetricStat.Metric.MetricName]
+		for i := len(values) - 1; i >= 0; i-- {
+			results = append(results, cwTypes.MetricDataResult{
+				Id:         query.Id,
+				Label:      query.Label,
+				StatusCode: cwTypes.StatusCodeComplete,
+				Values:     []float64{values[i]},
+				Timestamps: []time.Time{startTime.Add(time.Duration(i*int(*query.MetricStat.Period)) * time.Second)},
+			})
+		}
+	}
+	return results, nil
+}
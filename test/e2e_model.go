@@ -1,11 +1,17 @@
 package test
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
 	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/givery-technology/deployman/internal"
 )
@@ -16,6 +22,11 @@ type TestingState struct {
 	Bucket            *TestingBucket
 	LoadBalancer      *TestingLoadBalancer
 	AutoScalingGroups []TestingAutoScalingGroup
+	Alarms            []TestingAlarm
+	Throttles         map[string]int
+	Failures          map[string]int
+	Parameters        map[string]string
+	Instances         map[string]string // private IP address by instance ID
 }
 
 func NewTestingState(config *internal.Config) *TestingState {
@@ -28,6 +39,15 @@ func (s *TestingState) FindAutoScalingGroup(name string) *TestingAutoScalingGrou
 	})
 }
 
+func (s *TestingState) FindBucketObject(bucket string, key string) *TestingBucketObject {
+	if s.Bucket == nil || *s.Bucket.Name != bucket {
+		return nil
+	}
+	return internal.FirstOrNil(s.Bucket.Objects, func(o *TestingBucketObject) bool {
+		return *o.Key == key
+	})
+}
+
 type TestingBucket struct {
 	Name                   *string
 	IsVersioningEnabled    *bool
@@ -41,6 +61,88 @@ type TestingBucketObject struct {
 	Key          *string
 	Value        []byte
 	ContentType  *string
+	ETag         *string
+	Metadata     map[string]string
+	Parts        int // number of the parts in the last upload or download
+}
+
+// TestingAlarm The state changes each time the alarm is described, and the last state remains.
+type TestingAlarm struct {
+	Name   *string
+	States []cwTypes.StateValue
+}
+
+func (a *TestingAlarm) nextState() cwTypes.StateValue {
+	state := a.States[0]
+	if len(a.States) > 1 {
+		a.States = a.States[1:]
+	}
+	return state
+}
+
+// FindLatestBucketObject The latest one of the same key, as the versioned bucket returns.
+func (s *TestingState) FindLatestBucketObject(bucket string, key string) *TestingBucketObject {
+	if s.Bucket == nil || *s.Bucket.Name != bucket {
+		return nil
+	}
+	var object *TestingBucketObject
+	for i := range s.Bucket.Objects {
+		if *s.Bucket.Objects[i].Key == key {
+			object = &s.Bucket.Objects[i]
+		}
+	}
+	return object
+}
+
+func (s *TestingState) WithAlarm(name string, states ...cwTypes.StateValue) *TestingState {
+	s.Alarms = append(s.Alarms, TestingAlarm{Name: aws.String(name), States: states})
+	return s
+}
+
+func (s *TestingState) WithParameter(name string, value string) *TestingState {
+	if s.Parameters == nil {
+		s.Parameters = map[string]string{}
+	}
+	s.Parameters[name] = value
+	return s
+}
+
+// WithThrottling The API is throttled the number of times before it succeeds.
+func (s *TestingState) WithThrottling(api string, count int) *TestingState {
+	if s.Throttles == nil {
+		s.Throttles = map[string]int{}
+	}
+	s.Throttles[api] = count
+	return s
+}
+
+// WithFailure The API succeeds the number of times, and then keeps failing with a service error.
+func (s *TestingState) WithFailure(api string, successes int) *TestingState {
+	if s.Failures == nil {
+		s.Failures = map[string]int{}
+	}
+	s.Failures[api] = successes
+	return s
+}
+
+func (s *TestingState) failed(api string) bool {
+	successes, ok := s.Failures[api]
+	if !ok {
+		return false
+	}
+	if successes <= 0 {
+		return true
+	}
+	s.Failures[api]--
+	return false
+}
+
+func (s *TestingState) throttled(api string) bool {
+	if s.Throttles[api] <= 0 {
+		return false
+	}
+	s.Throttles[api]--
+	return true
 }
 
 type TestingLoadBalancer struct {
@@ -59,6 +161,10 @@ type TestingTargetGroup struct {
 	*albTypes.TargetGroupTuple
 	TargetGroupName *string
 	HealthStates    []albTypes.TargetHealthStateEnum
+	TargetType      albTypes.TargetTypeEnum
+	TargetAddress   *string
+	TargetPort      *int32
+	Metrics         map[string][]float64
 }
 
 type TestingAutoScalingGroup struct {
@@ -77,6 +183,52 @@ func (s *TestingState) WithBucket(config *internal.Config) *TestingState {
 	return s
 }
 
+// WithLargeBundle A registered bundle of the size with the pseudo-random content, active in blue.
+func (s *TestingState) WithLargeBundle(bundleName string, size int) *TestingState {
+	raw := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(int64(size))).Read(raw)
+	sum := sha256.Sum256(raw)
+	checksum := hex.EncodeToString(sum[:])
+	manifest := []byte(fmt.Sprintf("%s  %s\n", checksum, bundleName))
+	key := internal.BundlePrefix + bundleName
+	s.Bucket.Objects = append(s.Bucket.Objects,
+		TestingBucketObject{
+			LastModified: aws.Time(time.Now()),
+			Key:          aws.String(key),
+			Value:        raw,
+			ETag:         newETag(raw),
+			Metadata:     map[string]string{internal.ChecksumMetadataKey: checksum},
+		},
+		TestingBucketObject{
+			LastModified: aws.Time(time.Now()),
+			Key:          aws.String(key + internal.ChecksumSuffix),
+			Value:        manifest,
+			ContentType:  aws.String("text/plain"),
+			ETag:         newETag(manifest),
+		},
+		TestingBucketObject{
+			LastModified: aws.Time(time.Now()),
+			Key:          aws.String(internal.ActiveBundleKeyPrefix + string(internal.BlueTargetType)),
+			Value:        []byte(bundleName),
+			ContentType:  aws.String("text/plain"),
+			ETag:         newETag([]byte(bundleName)),
+		},
+	)
+	return s
+}
+
+func (s *TestingState) WithLock(lock *internal.Lock) *TestingState {
+	raw, _ := json.Marshal(lock)
+	s.Bucket.Objects = append(s.Bucket.Objects, TestingBucketObject{
+		LastModified: aws.Time(time.Now()),
+		Key:          aws.String(internal.LockKey),
+		Value:        raw,
+		ContentType:  aws.String("text/plain"),
+		ETag:         newETag(raw),
+	})
+	return s
+}
+
 type (
 	BlueWeight        int32
 	BlueHealthStates  []albTypes.TargetHealthStateEnum
@@ -118,6 +270,44 @@ func (s *TestingState) WithLoadBalancer(
 	return s
 }
 
+// WithTargetAddress All targets of the target group are registered by the address.
+func (s *TestingState) WithTargetAddress(targetGroupArn string, host string, port int32) *TestingState {
+	targetGroup := s.LoadBalancer.FindTargetGroup(targetGroupArn)
+	targetGroup.TargetType = albTypes.TargetTypeEnumIp
+	targetGroup.TargetAddress = aws.String(host)
+	targetGroup.TargetPort = aws.Int32(port)
+	return s
+}
+
+// WithInstanceAddress All targets of the target group are instances with the private IP address, as the AutoScalingGroup registers.
+func (s *TestingState) WithInstanceAddress(targetGroupArn string, host string, port int32) *TestingState {
+	targetGroup := s.LoadBalancer.FindTargetGroup(targetGroupArn)
+	targetGroup.TargetType = albTypes.TargetTypeEnumInstance
+	targetGroup.TargetPort = aws.Int32(port)
+	if s.Instances == nil {
+		s.Instances = map[string]string{}
+	}
+	for i := range targetGroup.HealthStates {
+		s.Instances[targetInstanceId(targetGroup, i)] = host
+	}
+	return s
+}
+
+// targetInstanceId The instance ID of the i-th target of the target group, unique over the target groups.
+func targetInstanceId(targetGroup *TestingTargetGroup, i int) string {
+	return fmt.Sprintf("i-%s%d", *targetGroup.TargetGroupName, i)
+}
+
+// WithMetric Datapoints of the ALB metric of the target group, such as 'RequestCount'.
+func (s *TestingState) WithMetric(targetGroupArn string, metricName string, values ...float64) *TestingState {
+	targetGroup := s.LoadBalancer.FindTargetGroup(targetGroupArn)
+	if targetGroup.Metrics == nil {
+		targetGroup.Metrics = map[string][]float64{}
+	}
+	targetGroup.Metrics[metricName] = values
+	return s
+}
+
 type (
 	BlueDesiredCapacity  int32
 	BlueMinSize          int32
@@ -168,7 +358,7 @@ func (s *TestingState) WithAutoScalingGroups(
 						LifecycleState: *state,
 					}
 				}),
-				TargetGroupARNs: []string{s.config.Target.Blue.TargetGroupArn},
+				TargetGroupARNs: []string{s.config.Target.Green.TargetGroupArn},
 			},
 			ScheduledActions: []asgTypes.ScheduledUpdateGroupAction{},
 		},
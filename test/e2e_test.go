@@ -1,16 +1,35 @@
 package test
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	albTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go"
 	"github.com/givery-technology/deployman/internal"
 	"github.com/givery-technology/deployman/test/assert"
+	"github.com/pkg/errors"
 )
 
 const testdata = "./data"
@@ -18,15 +37,233 @@ const testdata = "./data"
 func TestE2E(t *testing.T) {
 	ctx := context.TODO()
 	logger := &internal.DefaultLogger{Verbose: true}
-	config, err := internal.NewConfig(ctx, new(MockAwsClient), testdata+"/default.json")
+	config, err := internal.NewConfig(ctx, new(MockAwsClient), testdata+"/default.json", "")
 	if err != nil {
 		t.Fatal("InvalidConfig", err)
 	}
 
+	t.Run("Config#Environments", func(t *testing.T) {
+		prod, err := internal.NewConfig(ctx, new(MockAwsClient), testdata+"/environments.json", "prod")
+		assert.Success(t, err)
+		assert.Equal(t, prod.Environment, "prod")
+		assert.Equal(t, prod.BundleBucket, "test-deploy-bundle-prod")
+		// the objects are merged field by field with the shared values and the defaults
+		assert.Equal(t, prod.Target.Blue.AutoScalingGroupName, "prod-blue-asg")
+		assert.Equal(t, prod.Target.Blue.TargetGroupArn, "arn:aws:elasticloadbalancing:::targetgroup/test-blue-tg/99999999")
+		assert.Equal(t, prod.Target.Green.AutoScalingGroupName, "test-green-asg")
+		assert.Equal(t, prod.RetryPolicy.MaxLimit, 60)
+		assert.Equal(t, prod.RetryPolicy.IntervalSeconds, 20)
+		assert.NotNil(t, prod.RetryPolicy.Throttling)
+		assert.Equal(t, prod.TimeZone.Location, "UTC")
+		assert.Equal(t, prod.TimeZone.Offset, 9*60*60)
+
+		dev, err := internal.NewConfig(ctx, new(MockAwsClient), testdata+"/environments.json", "dev")
+		assert.Success(t, err)
+		assert.Equal(t, dev.BundleBucket, "test-deploy-bundle-dev")
+		assert.Equal(t, dev.Target.Blue.AutoScalingGroupName, "test-blue-asg")
+		assert.Equal(t, dev.RetryPolicy.IntervalSeconds, 5)
+		assert.Equal(t, dev.TimeZone.Location, "Asia/Tokyo")
+
+		_, err = internal.NewConfig(ctx, new(MockAwsClient), testdata+"/environments.json", "")
+		assert.Failure(t, err)
+		_, err = internal.NewConfig(ctx, new(MockAwsClient), testdata+"/environments.json", "staging")
+		assert.Failure(t, err)
+		_, err = internal.NewConfig(ctx, new(MockAwsClient), testdata+"/default.json", "prod")
+		assert.Failure(t, err)
+
+		// the variables are interpolated only in the selected environment
+		client := NewMockAwsClient(NewTestingState(config).
+			WithParameter("/deployman/environments", `{"bundleBucket": "shared", "listenerRuleArn": "arn", "target": {"blue": {"autoScalingGroupName": "blue", "targetGroupArn": "blue"}, "green": {"autoScalingGroupName": "green", "targetGroupArn": "green"}}, "environments": {"dev": {}, "prod": {"bundleBucket": "${DEPLOYMAN_TEST_PROD_ONLY}"}}}`))
+		dev, err = internal.NewConfig(ctx, client, "ssm:/deployman/environments", "dev")
+		assert.Success(t, err)
+		assert.Equal(t, dev.BundleBucket, "shared")
+		_, err = internal.NewConfig(ctx, client, "ssm:/deployman/environments", "prod")
+		assert.Failure(t, err)
+		assert.True(t, strings.Contains(err.Error(), "'DEPLOYMAN_TEST_PROD_ONLY' referenced in 'environments.prod.bundleBucket'"))
+		_, err = internal.NewConfig(ctx, client, "ssm:/deployman/environments", "")
+		assert.True(t, strings.Contains(err.Error(), "Valid values are dev, prod."))
+
+		// a partial strategy is filled with the defaults of the fixed type
+		client = NewMockAwsClient(NewTestingState(config).
+			WithParameter("/deployman/retry", `{"bundleBucket": "bucket", "listenerRuleArn": "arn", "target": {"blue": {"autoScalingGroupName": "blue", "targetGroupArn": "blue"}, "green": {"autoScalingGroupName": "green", "targetGroupArn": "green"}}, "retryPolicy": {"intervalSeconds": 5, "healthCheck": {"maxLimit": 10}, "throttling": {"maxLimit": 3}}}`))
+		retryConfig, err := internal.NewConfig(ctx, client, "ssm:/deployman/retry", "")
+		assert.Success(t, err)
+		healthCheck := retryConfig.RetryPolicy.HealthCheckStrategy()
+		assert.Equal(t, healthCheck.Type, internal.RetryTypeFixed)
+		assert.Equal(t, healthCheck.MaxLimit, 10)
+		assert.Equal(t, healthCheck.IntervalSeconds, 5)
+		assert.Equal(t, retryConfig.RetryPolicy.ThrottlingStrategy().Type, internal.RetryTypeJitter)
+		assert.Equal(t, retryConfig.RetryPolicy.ThrottlingStrategy().MaxLimit, 3)
+
+		_, err = internal.NewConfig(ctx, new(MockAwsClient), testdata+"/environments.json", "broken")
+		assert.Failure(t, err)
+		assert.True(t, strings.Contains(err.Error(), "'broken' environment"))
+		assert.True(t, strings.Contains(err.Error(), "target.green.autoScalingGroupName: required"))
+		assert.True(t, strings.Contains(err.Error(), "cancellation.timeoutSeconds: min=1"))
+	})
+
+	t.Run("Config#YamlAndInterpolation", func(t *testing.T) {
+		t.Setenv("DEPLOYMAN_TEST_BUCKET", "ci-deploy-bundle")
+		yamlConfig, err := internal.NewConfig(ctx, new(MockAwsClient), testdata+"/default.yaml", "")
+		assert.Success(t, err)
+		assert.Equal(t, yamlConfig.BundleBucket, "ci-deploy-bundle")
+		assert.Equal(t, yamlConfig.Target.Blue.AutoScalingGroupName, "test-blue-asg")
+		assert.Equal(t, yamlConfig.RetryPolicy.MaxLimit, 60)
+		assert.Equal(t, yamlConfig.RetryPolicy.IntervalSeconds, 10)
+		assert.Equal(t, yamlConfig.Hooks.AfterSwap[0], "echo ci-deploy-bundle")
+
+		t.Setenv("DEPLOYMAN_TEST_PREFIX", "ci")
+		yamlConfig, err = internal.NewConfig(ctx, new(MockAwsClient), testdata+"/default.yaml", "")
+		assert.Success(t, err)
+		assert.Equal(t, yamlConfig.Target.Green.AutoScalingGroupName, "ci-green-asg")
+
+		// the config in SSM is interpolated too, whether it is JSON or YAML
+		raw, err := os.ReadFile(testdata + "/default.yaml")
+		assert.Success(t, err)
+		client := NewMockAwsClient(NewTestingState(config).
+			WithParameter("/deployman/yaml", string(raw)).
+			WithParameter("/deployman/json", `{"bundleBucket": "${DEPLOYMAN_TEST_BUCKET}", "listenerRuleArn": "arn", "target": {"blue": {"autoScalingGroupName": "blue", "targetGroupArn": "blue"}, "green": {"autoScalingGroupName": "green", "targetGroupArn": "green"}}}`))
+		ssmConfig, err := internal.NewConfig(ctx, client, "ssm:/deployman/yaml", "")
+		assert.Success(t, err)
+		assert.Equal(t, ssmConfig.BundleBucket, "ci-deploy-bundle")
+		ssmConfig, err = internal.NewConfig(ctx, client, "ssm:/deployman/json", "")
+		assert.Success(t, err)
+		assert.Equal(t, ssmConfig.BundleBucket, "ci-deploy-bundle")
+
+		// $${NAME} is kept as the literal ${NAME} for the shell of the hooks
+		client = NewMockAwsClient(NewTestingState(config).
+			WithParameter("/deployman/hook", `{"bundleBucket": "${DEPLOYMAN_TEST_BUCKET}", "listenerRuleArn": "arn", "target": {"blue": {"autoScalingGroupName": "blue", "targetGroupArn": "blue"}, "green": {"autoScalingGroupName": "green", "targetGroupArn": "green"}}, "hooks": {"afterSwap": ["./notify.sh $${DEPLOYMAN_HOOK} ${DEPLOYMAN_TEST_PREFIX}"]}}`))
+		hookConfig, err := internal.NewConfig(ctx, client, "ssm:/deployman/hook", "")
+		assert.Success(t, err)
+		assert.Equal(t, hookConfig.Hooks.AfterSwap[0], "./notify.sh ${DEPLOYMAN_HOOK} ci")
+
+		// bad references fail with the field and the variable
+		os.Unsetenv("DEPLOYMAN_TEST_BUCKET")
+		_, err = internal.NewConfig(ctx, new(MockAwsClient), testdata+"/default.yaml", "")
+		assert.Failure(t, err)
+		assert.True(t, strings.Contains(err.Error(), "'DEPLOYMAN_TEST_BUCKET'"))
+
+		// the first field in order is reported when several fields are bad
+		path := t.TempDir() + "/deployman.yml"
+		assert.Success(t, os.WriteFile(path, []byte("listenerRuleArn: \"${DEPLOYMAN_TEST_RULE}\"\nbundleBucket: \"${DEPLOYMAN_TEST_BUCKET}\"\n"), 0644))
+		for range 10 {
+			_, err = internal.NewConfig(ctx, new(MockAwsClient), path, "")
+			assert.True(t, strings.Contains(err.Error(), "'DEPLOYMAN_TEST_BUCKET' referenced in 'bundleBucket'"))
+		}
+		for value, message := range map[string]string{
+			"${DEPLOYMAN_TEST_BUCKET":  "Unclosed reference in 'bundleBucket'",
+			"${1BUCKET}":               "Invalid reference '${1BUCKET}' in 'bundleBucket'",
+			"bundle-${}":               "Invalid reference '${}' in 'bundleBucket'",
+			"${DEPLOYMAN_TEST_BUCKET}": "'DEPLOYMAN_TEST_BUCKET' referenced in 'bundleBucket'",
+		} {
+			path = t.TempDir() + "/deployman.yml"
+			assert.Success(t, os.WriteFile(path, []byte("bundleBucket: \""+value+"\"\n"), 0644))
+			_, err = internal.NewConfig(ctx, new(MockAwsClient), path, "")
+			assert.Failure(t, err)
+			assert.True(t, strings.Contains(err.Error(), message))
+		}
+	})
+
+	t.Run("Config#Validate", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		checker := internal.NewConfigChecker(config, NewMockAwsClient(state), logger)
+		output := checker.Check(ctx)
+		assert.Equal(t, len(output.Checks), 10)
+		assert.Equal(t, output.Failures(), 0)
+		assert.Success(t, checker.Validate(ctx, "table"))
+
+		// a typo in the target group ARN of green, and an ASG that does not exist
+		typo := *config
+		typo.Target = &internal.TargetSet{
+			Blue: &internal.Target{
+				AutoScalingGroupName: "typo-blue-asg",
+				TargetGroupArn:       config.Target.Blue.TargetGroupArn,
+			},
+			Green: &internal.Target{
+				AutoScalingGroupName: config.Target.Green.AutoScalingGroupName,
+				TargetGroupArn:       config.Target.Green.TargetGroupArn + "0",
+			},
+		}
+		state.Bucket = nil
+		checker = internal.NewConfigChecker(&typo, NewMockAwsClient(state), logger)
+		output = checker.Check(ctx)
+		failed := internal.Map(internal.Filter(output.Checks, func(c *internal.ConfigCheck) bool { return !c.Passed }),
+			func(_ int, c *internal.ConfigCheck) *string { return &c.Name })
+		assert.Equal(t, strings.Join(failed, ","), strings.Join([]string{
+			"bundle bucket exists",
+			"blue auto scaling group exists",
+			"blue target group attached to auto scaling group",
+			"green target group exists",
+			"green target group in listener rule",
+			"green target group attached to auto scaling group",
+		}, ","))
+		err := checker.Validate(ctx, "json")
+		assert.Failure(t, err)
+		assert.True(t, errors.Is(err, internal.ConfigCheckError))
+	})
+
+	t.Run("Init", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		// the other AutoScalingGroups of the region, over the pages
+		for i := 0; i < MockPageSize*2; i++ {
+			state.AutoScalingGroups = append([]TestingAutoScalingGroup{{
+				AutoScalingGroup: &asgTypes.AutoScalingGroup{AutoScalingGroupName: aws.String(fmt.Sprintf("other-asg-%d", i))},
+			}}, state.AutoScalingGroups...)
+		}
+		initializer := internal.NewInitializer(NewMockAwsClient(state), logger)
+
+		raw, err := initializer.Discover(ctx, config.ListenerRuleArn, "")
+		assert.Success(t, err)
+		path := t.TempDir() + "/deployman.json"
+		assert.Success(t, initializer.Write(ctx, raw, path, false))
+		generated, err := internal.NewConfig(ctx, new(MockAwsClient), path, "")
+		assert.Success(t, err)
+		assert.Equal(t, generated.ListenerRuleArn, config.ListenerRuleArn)
+		assert.Equal(t, generated.BundleBucket, "test-listener-deployman")
+		assert.Equal(t, *generated.Target.Blue, *config.Target.Blue)
+		assert.Equal(t, *generated.Target.Green, *config.Target.Green)
+
+		// the existing config is kept unless forced
+		assert.Failure(t, initializer.Write(ctx, raw, path, false))
+		assert.Success(t, initializer.Write(ctx, raw, path, true))
+
+		raw, err = initializer.Discover(ctx, config.ListenerRuleArn, "my-bundle-bucket")
+		assert.Success(t, err)
+		assert.Success(t, initializer.Write(ctx, raw, "ssm:/deployman/config", false))
+		assert.Failure(t, initializer.Write(ctx, raw, "ssm:/deployman/config", false))
+		generated, err = internal.NewConfig(ctx, NewMockAwsClient(state), "ssm:/deployman/config", "")
+		assert.Success(t, err)
+		assert.Equal(t, generated.BundleBucket, "my-bundle-bucket")
+
+		// a target group without its AutoScalingGroup
+		state.FindAutoScalingGroup(config.Target.Green.AutoScalingGroupName).TargetGroupARNs = nil
+		_, err = initializer.Discover(ctx, config.ListenerRuleArn, "")
+		assert.Failure(t, err)
+		_, err = initializer.Discover(ctx, config.ListenerRuleArn+"0", "")
+		assert.Failure(t, err)
+	})
+
 	t.Run("BundleRegister#IfNoBucket", func(t *testing.T) {
 		state := NewTestingState(config)
 		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
-		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "bundle.zip"))
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "bundle.zip", "", nil))
 		assert.True(t, len(*state.Bucket.Name) >= 0)
 		assert.True(t, *state.Bucket.IsPublicAccessDisabled)
 		assert.True(t, *state.Bucket.IsVersioningEnabled)
@@ -38,9 +275,68 @@ func TestE2E(t *testing.T) {
 		state := NewTestingState(config)
 		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
 		for i := 0; i < 101; i++ {
-			assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "bundle.zip"))
+			assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "bundle.zip", "", nil))
 		}
-		assert.Equal(t, len(state.Bucket.Objects), internal.MaxKeepBundles)
+		bundles := internal.Filter(state.Bucket.Objects, func(o *TestingBucketObject) bool {
+			return !strings.HasSuffix(*o.Key, internal.ChecksumSuffix)
+		})
+		assert.Equal(t, len(bundles), internal.MaxKeepBundles)
+		assert.NotNil(t, state.FindBucketObject(config.BundleBucket, internal.BundlePrefix+"bundle.zip"+internal.ChecksumSuffix))
+	})
+
+	t.Run("BundleRegister#Checksum", func(t *testing.T) {
+		state := NewTestingState(config)
+		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
+		bundleName := "checksum.zip"
+		key := internal.BundlePrefix + bundleName
+		t.Cleanup(func() {
+			_ = os.Remove(bundleName)
+		})
+
+		raw, err := os.ReadFile(testdata + "/bundle.zip")
+		assert.Success(t, err)
+		sum := sha256.Sum256(raw)
+		checksum := hex.EncodeToString(sum[:])
+
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", bundleName, "", nil))
+		assert.Equal(t, state.FindBucketObject(config.BundleBucket, key).Metadata[internal.ChecksumMetadataKey], checksum)
+		manifest := state.FindBucketObject(config.BundleBucket, key+internal.ChecksumSuffix)
+		assert.Equal(t, string(manifest.Value), checksum+"  "+bundleName+"\n")
+		assert.Success(t, bundler.Activate(ctx, internal.BlueTargetType, bundleName))
+
+		// the manifest is not listed as a bundle
+		stdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		err = bundler.ListBundles(ctx, "json", nil, nil)
+		w.Close()
+		os.Stdout = stdout
+		assert.Success(t, err)
+		var output internal.BundleListOutput
+		assert.Success(t, json.NewDecoder(r).Decode(&output))
+		assert.Equal(t, len(output.Bundles), 1)
+		assert.Equal(t, output.Bundles[0].BundleName, bundleName)
+		assert.Equal(t, output.Bundles[0].Sha256, checksum)
+
+		assert.Success(t, bundler.Download(ctx, internal.BlueTargetType, "", "", ""))
+		downloaded, err := os.ReadFile(bundleName)
+		assert.Success(t, err)
+		assert.Equal(t, string(downloaded), string(raw))
+		assert.Success(t, os.Remove(bundleName))
+
+		// the bundle is replaced after register
+		object := state.FindBucketObject(config.BundleBucket, key)
+		object.Value = append(object.Value, '!')
+		err = bundler.Download(ctx, internal.BlueTargetType, "", "", "")
+		assert.True(t, errors.Is(err, internal.ChecksumError))
+		_, err = os.Stat(bundleName)
+		assert.True(t, os.IsNotExist(err))
+
+		// the manifest disagrees with the metadata
+		object.Value = raw
+		manifest = state.FindBucketObject(config.BundleBucket, key+internal.ChecksumSuffix)
+		manifest.Value = []byte(strings.Repeat("0", 64) + "  " + bundleName + "\n")
+		assert.True(t, errors.Is(bundler.Download(ctx, internal.BlueTargetType, "", "", ""), internal.ChecksumError))
 	})
 
 	t.Run("BundleRegister#ActivationAndDownload", func(t *testing.T) {
@@ -48,7 +344,7 @@ func TestE2E(t *testing.T) {
 		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
 		bundleName := "bundle.zip"
 
-		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", bundleName))
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", bundleName, "", nil))
 
 		assert.True(t, len(*state.Bucket.Name) >= 0)
 		assert.True(t, *state.Bucket.IsPublicAccessDisabled)
@@ -58,16 +354,236 @@ func TestE2E(t *testing.T) {
 
 		assert.Success(t, bundler.Activate(ctx, internal.BlueTargetType, bundleName))
 		assert.Success(t, bundler.Activate(ctx, internal.GreenTargetType, bundleName))
-		assert.Success(t, bundler.ListBundles(ctx, "table"))
+		assert.Success(t, bundler.ListBundles(ctx, "table", internal.DefaultBundleColumns, nil))
 
 		t.Cleanup(func() {
 			_ = os.Remove(bundleName) // Measures to clean up downloaded files later
 		})
-		assert.Success(t, bundler.Download(ctx, internal.BlueTargetType))
+		assert.Success(t, bundler.Download(ctx, internal.BlueTargetType, "", "", ""))
+	})
+
+	t.Run("BundleRegister#LargeBundle", func(t *testing.T) {
+		const size = 24*MockPartSize + 123
+		state := NewTestingState(config).WithBucket(config).WithLargeBundle("large.zip", size)
+		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
+		t.Cleanup(func() {
+			_ = os.Remove("large.zip")
+		})
+
+		// streamed to the file, rather than the whole bundle in memory
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		assert.Success(t, bundler.Download(ctx, internal.BlueTargetType, "", "", ""))
+		runtime.ReadMemStats(&after)
+		assert.True(t, after.TotalAlloc-before.TotalAlloc < size/4)
+
+		object := state.FindBucketObject(config.BundleBucket, internal.BundlePrefix+"large.zip")
+		assert.Equal(t, object.Parts, 25)
+		downloaded, err := os.ReadFile("large.zip")
+		assert.Success(t, err)
+		assert.True(t, bytes.Equal(downloaded, object.Value))
+		partFiles, err := filepath.Glob("large.zip.*.part")
+		assert.Success(t, err)
+		assert.Equal(t, len(partFiles), 0)
+
+		// registered again from the downloaded file in parts
+		assert.Success(t, bundler.Register(ctx, "large.zip", "large-copy.zip", "", nil))
+		copied := state.FindBucketObject(config.BundleBucket, internal.BundlePrefix+"large-copy.zip")
+		assert.Equal(t, copied.Parts, 25)
+		assert.True(t, bytes.Equal(copied.Value, object.Value))
+		assert.Equal(t, copied.Metadata[internal.ChecksumMetadataKey], object.Metadata[internal.ChecksumMetadataKey])
+
+	})
+
+	t.Run("BundleDownload#Options", func(t *testing.T) {
+		state := NewTestingState(config)
+		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
+		dir := t.TempDir()
+		raw, err := os.ReadFile(testdata + "/bundle.zip")
+		assert.Success(t, err)
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "app.zip", "", nil))
+
+		// by name, not activated in any target
+		assert.Success(t, bundler.Download(ctx, "", "app.zip", dir+"/renamed.zip", ""))
+		downloaded, err := os.ReadFile(dir + "/renamed.zip")
+		assert.Success(t, err)
+		assert.True(t, bytes.Equal(downloaded, raw))
+		info, err := os.Stat(dir + "/renamed.zip")
+		assert.Success(t, err)
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0644))
+
+		// into the directory under the bundle name
+		assert.Success(t, bundler.Download(ctx, "", "app.zip", dir, ""))
+		_, err = os.Stat(dir + "/app.zip")
+		assert.Success(t, err)
+
+		// to stdout
+		stdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		received := make(chan []byte)
+		go func() {
+			buf, _ := io.ReadAll(r)
+			received <- buf
+		}()
+		err = bundler.Download(ctx, "", "app.zip", "-", "")
+		w.Close()
+		os.Stdout = stdout
+		assert.Success(t, err)
+		assert.True(t, bytes.Equal(<-received, raw))
+
+		// extracted
+		assert.Success(t, bundler.Download(ctx, "", "app.zip", "", dir+"/app"))
+		extracted, err := os.ReadFile(dir + "/app/default.json")
+		assert.Success(t, err)
+		assert.True(t, json.Valid(extracted))
+		partFiles, err := filepath.Glob(dir + "/*.part")
+		assert.Success(t, err)
+		assert.Equal(t, len(partFiles), 0)
+
+		assert.Failure(t, bundler.Download(ctx, "", "missing.zip", dir, ""))
+		assert.Failure(t, bundler.Download(ctx, "", "", dir, ""))
+		assert.Failure(t, bundler.Download(ctx, internal.BlueTargetType, "app.zip", dir, ""))
+		assert.Failure(t, bundler.Download(ctx, "", "app.zip", dir, dir+"/app"))
+
+		// the entry escaping the extract directory
+		buf := new(bytes.Buffer)
+		archive := zip.NewWriter(buf)
+		entry, err := archive.Create("../escaped.txt")
+		assert.Success(t, err)
+		_, err = entry.Write([]byte("escaped"))
+		assert.Success(t, err)
+		assert.Success(t, archive.Close())
+		assert.Success(t, os.WriteFile(dir+"/evil.zip", buf.Bytes(), 0644))
+		assert.Success(t, bundler.Register(ctx, dir+"/evil.zip", "evil.zip", "", nil))
+		assert.Failure(t, bundler.Download(ctx, "", "evil.zip", "", dir+"/evil"))
+		_, err = os.Stat(dir + "/escaped.txt")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("BundleRegister#Signature", func(t *testing.T) {
+		dir := t.TempDir()
+		writeKeyPair := func(name string) string {
+			publicKey, privateKey, err := ed25519.GenerateKey(nil)
+			assert.Success(t, err)
+			privateDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+			assert.Success(t, err)
+			assert.Success(t, os.WriteFile(dir+"/"+name, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer}), 0600))
+			publicDer, err := x509.MarshalPKIXPublicKey(publicKey)
+			assert.Success(t, err)
+			return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+		}
+		ciPublicKey := writeKeyPair("ci.pem")
+		writeKeyPair("other.pem")
+
+		signed := *config
+		signed.RequireSignature = true
+		signed.SignaturePublicKeys = []string{ciPublicKey}
+		state := NewTestingState(&signed)
+		bundler := internal.NewBundler(&signed, NewMockAwsClient(state), logger)
+		t.Cleanup(func() {
+			_ = os.Remove("signed.zip")
+		})
+
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "signed.zip", dir+"/ci.pem", nil))
+		assert.NotNil(t, state.FindBucketObject(signed.BundleBucket, internal.BundlePrefix+"signed.zip"+internal.SignatureSuffix))
+		assert.Success(t, bundler.Activate(ctx, internal.BlueTargetType, "signed.zip"))
+		assert.Success(t, bundler.Download(ctx, internal.BlueTargetType, "", "", ""))
+
+		// unsigned and wrongly signed bundles never reach the active bundle
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "unsigned.zip", "", nil))
+		assert.True(t, errors.Is(bundler.Activate(ctx, internal.BlueTargetType, "unsigned.zip"), internal.SignatureError))
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "other.zip", dir+"/other.pem", nil))
+		assert.True(t, errors.Is(bundler.Activate(ctx, internal.BlueTargetType, "other.zip"), internal.SignatureError))
+		active := state.FindBucketObject(signed.BundleBucket, internal.ActiveBundleKeyPrefix+string(internal.BlueTargetType))
+		assert.Equal(t, string(active.Value), "signed.zip")
+
+		// the bundle activated before the signature was required
+		active.Value = []byte("unsigned.zip")
+		assert.True(t, errors.Is(bundler.Download(ctx, internal.BlueTargetType, "", "", ""), internal.SignatureError))
+
+		// the key is rotated
+		signed.SignaturePublicKeys = []string{ciPublicKey, writeKeyPair("next.pem")}
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "next.zip", dir+"/next.pem", nil))
+		assert.Success(t, bundler.Activate(ctx, internal.BlueTargetType, "next.zip"))
+
+		// without requireSignature, the unsigned bundle is still allowed
+		signed.RequireSignature = false
+		assert.Success(t, bundler.Activate(ctx, internal.BlueTargetType, "unsigned.zip"))
+		assert.True(t, errors.Is(bundler.Activate(ctx, internal.BlueTargetType, "other.zip"), internal.SignatureError))
+	})
+
+	t.Run("BundleRegister#Labels", func(t *testing.T) {
+		state := NewTestingState(config)
+		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
+		listBundles := func(filters map[string]string) []internal.BundleListItem {
+			stdout := os.Stdout
+			r, w, _ := os.Pipe()
+			os.Stdout = w
+			err := bundler.ListBundles(ctx, "json", nil, filters)
+			w.Close()
+			os.Stdout = stdout
+			assert.Success(t, err)
+			var output internal.BundleListOutput
+			assert.Success(t, json.NewDecoder(r).Decode(&output))
+			return output.Bundles
+		}
+
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "main.zip", "", map[string]string{
+			"Release":               "v1.2.0",
+			internal.LabelGitBranch: "main",
+			"note":                  "hotfix for #42",
+		}))
+		assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", "feature.zip", "", map[string]string{
+			internal.LabelGitBranch: "feature/login",
+		}))
+		metadata := state.FindBucketObject(config.BundleBucket, internal.BundlePrefix+"main.zip").Metadata
+		assert.Equal(t, metadata["release"], "v1.2.0")
+		assert.Equal(t, metadata["note"], "hotfix%20for%20%2342")
+
+		bundles := listBundles(nil)
+		assert.Equal(t, len(bundles), 2)
+		assert.Equal(t, bundles[1].BundleName, "main.zip")
+		assert.Equal(t, bundles[1].Labels["note"], "hotfix for #42")
+		assert.Equal(t, bundles[1].Labels[internal.LabelGitBranch], "main")
+		_, ok := bundles[1].Labels[internal.ChecksumMetadataKey]
+		assert.False(t, ok)
+
+		// the number is the position in the unfiltered list, so that it points the same bundle whatever the filters are
+		bundles = listBundles(map[string]string{internal.LabelGitBranch: "main"})
+		assert.Equal(t, len(bundles), 1)
+		assert.Equal(t, bundles[0].BundleName, "main.zip")
+		assert.Equal(t, bundles[0].Number, 2)
+		assert.Equal(t, len(listBundles(map[string]string{internal.LabelGitBranch: "main", "release": "v1.3.0"})), 0)
+
+		// the labels fetched concurrently belong to their own bundles
+		for i := range internal.BundleHeadConcurrency * 2 {
+			assert.Success(t, bundler.Register(ctx, testdata+"/bundle.zip", fmt.Sprintf("build-%d.zip", i), "", map[string]string{
+				"release": fmt.Sprintf("build-%d", i),
+			}))
+		}
+		bundles = listBundles(nil)
+		assert.Equal(t, len(bundles), internal.BundleHeadConcurrency*2+2)
+		for i, bundle := range bundles {
+			assert.Equal(t, bundle.Number, i+1)
+			if release, ok := bundle.Labels["release"]; ok && strings.HasPrefix(release, "build-") {
+				assert.Equal(t, bundle.BundleName, release+".zip")
+			}
+		}
+		assert.Equal(t, listBundles(map[string]string{internal.LabelGitBranch: "main"})[0].BundleName, "main.zip")
+
+		assert.Success(t, bundler.ListBundles(ctx, "table", []string{"release", internal.LabelGitBranch}, nil))
+
+		err := bundler.Register(ctx, testdata+"/bundle.zip", "invalid.zip", "", map[string]string{"sha256": "0"})
+		assert.Failure(t, err)
+		err = bundler.Register(ctx, testdata+"/bundle.zip", "invalid.zip", "", map[string]string{"build url": "x"})
+		assert.Failure(t, err)
 	})
 
 	t.Run("EC2Deploy", func(t *testing.T) {
 		state := NewTestingState(config).
+			WithBucket(config).
 			WithLoadBalancer(
 				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
 				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
@@ -78,7 +594,7 @@ func TestE2E(t *testing.T) {
 			)
 		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
 
-		assert.Success(t, deployer.Deploy(ctx, true, true, true, aws.Duration(time.Duration(1))))
+		assert.Success(t, deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 50, BakeTime: 1}, {Weight: 100}}))
 
 		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
 		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(0))
@@ -91,10 +607,13 @@ func TestE2E(t *testing.T) {
 
 		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).MaxSize, int32(2))
 		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Green.AutoScalingGroupName).MaxSize, int32(2))
+
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.CheckpointKey))
 	})
 
 	t.Run("EC2Rollback", func(t *testing.T) {
 		state := NewTestingState(config).
+			WithBucket(config).
 			WithLoadBalancer(
 				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
 				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
@@ -105,7 +624,7 @@ func TestE2E(t *testing.T) {
 			)
 		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
 
-		assert.Success(t, deployer.Deploy(ctx, true, false, false, aws.Duration(time.Duration(1))))
+		assert.Success(t, deployer.Deploy(ctx, true, false, false, internal.TrafficSteps{{Weight: 50, BakeTime: 1}, {Weight: 100}}))
 
 		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
 		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(0))
@@ -120,8 +639,790 @@ func TestE2E(t *testing.T) {
 		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Green.AutoScalingGroupName).MaxSize, int32(2))
 	})
 
+	t.Run("EC2Deploy#Hooks", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		dir := t.TempDir()
+		hooked := *config
+		hooked.Hooks = &internal.Hooks{
+			BeforeSwap:     []string{"cat > " + dir + "/info.json"},
+			AfterSwap:      []string{"echo \"$DEPLOYMAN_HOOK $DEPLOYMAN_IDLING_TARGET $DEPLOYMAN_IDLING_AUTO_SCALING_GROUP_NAME\" > " + dir + "/env.txt"},
+			TimeoutSeconds: 10,
+		}
+		deployer := internal.NewDeployer(&hooked, NewMockAwsClient(state), logger)
+
+		assert.Success(t, deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}}))
+
+		raw, err := os.ReadFile(dir + "/info.json")
+		assert.Success(t, err)
+		var info internal.DeployInfo
+		assert.Success(t, json.Unmarshal(raw, &info))
+		assert.Equal(t, info.IdlingTarget.Type, internal.BlueTargetType)
+		assert.Equal(t, *info.RunningTarget.AutoScalingGroup.AutoScalingGroupName, config.Target.Green.AutoScalingGroupName)
+
+		raw, err = os.ReadFile(dir + "/env.txt")
+		assert.Success(t, err)
+		assert.Equal(t, string(raw), "afterSwap blue "+config.Target.Blue.AutoScalingGroupName+"\n")
+	})
+
+	t.Run("EC2Deploy#HookFailed", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		hooked := *config
+		hooked.Hooks = &internal.Hooks{
+			AfterCleanup:   []string{"exit 1"},
+			TimeoutSeconds: 10,
+		}
+		deployer := internal.NewDeployer(&hooked, NewMockAwsClient(state), logger)
+
+		err := deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}})
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "'afterCleanup' hook failed"))
+
+		// the traffic and the capacity are restored
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Green.AutoScalingGroupName).MinSize, int32(1))
+	})
+
+	t.Run("EC2Deploy#SmokeTest", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/health" && r.Header.Get("X-Smoke-Test") == "1":
+				_, _ = w.Write([]byte(`{"status":"ok","version":"2"}`))
+			case r.URL.Path == "/health":
+				w.WriteHeader(http.StatusForbidden)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+		address := server.Listener.Addr().(*net.TCPAddr)
+
+		newInstanceState := func() *TestingState {
+			return NewTestingState(config).
+				WithBucket(config).
+				WithLoadBalancer(
+					BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy, albTypes.TargetHealthStateEnumHealthy},
+					GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				).
+				WithAutoScalingGroups(
+					BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+					GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+				).
+				WithInstanceAddress(config.Target.Blue.TargetGroupArn, address.IP.String(), int32(address.Port))
+		}
+		newState := func() *TestingState {
+			return newInstanceState().WithTargetAddress(config.Target.Blue.TargetGroupArn, address.IP.String(), int32(address.Port))
+		}
+		tested := *config
+		tested.SmokeTest = &internal.SmokeTest{
+			Scheme:         "http",
+			TimeoutSeconds: 1,
+			Requests: []internal.SmokeTestRequest{
+				{Path: "/health", Headers: map[string]string{"X-Smoke-Test": "1"}, BodyPattern: `"version":"2"`},
+				{Path: "/not-found", Method: "head", ExpectedStatus: http.StatusNotFound},
+			},
+		}
+
+		state := newState()
+		deployer := internal.NewDeployer(&tested, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}}))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+
+		// the instance targets registered by the AutoScalingGroup are sent to their private IP addresses
+		state = newInstanceState()
+		deployer = internal.NewDeployer(&tested, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}}))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+
+		// the instance is not found
+		state = newInstanceState()
+		state.Instances = nil
+		deployer = internal.NewDeployer(&tested, NewMockAwsClient(state), logger)
+		err := deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}})
+		assert.Failure(t, err)
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+
+		// the body does not match
+		tested.SmokeTest.Requests[0].BodyPattern = `"version":"3"`
+		state = newState()
+		deployer = internal.NewDeployer(&tested, NewMockAwsClient(state), logger)
+		err = deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}})
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+
+		// an invalid pattern is rejected with the config, and rolled back if it is not validated
+		client := NewMockAwsClient(NewTestingState(config).
+			WithParameter("/deployman/smoke", `{"bundleBucket": "bucket", "listenerRuleArn": "arn", "target": {"blue": {"autoScalingGroupName": "blue", "targetGroupArn": "blue"}, "green": {"autoScalingGroupName": "green", "targetGroupArn": "green"}}, "smokeTest": {"requests": [{"path": "/health", "bodyPattern": "("}]}}`))
+		_, err = internal.NewConfig(ctx, client, "ssm:/deployman/smoke", "")
+		assert.Failure(t, err)
+		assert.True(t, strings.Contains(err.Error(), "smokeTest.requests[0].bodyPattern: regexp"))
+		tested.SmokeTest.Requests[0].BodyPattern = `(`
+		state = newState()
+		deployer = internal.NewDeployer(&tested, NewMockAwsClient(state), logger)
+		err = deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}})
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+
+		// unexpected status
+		tested.SmokeTest.Requests[0] = internal.SmokeTestRequest{Path: "/health"}
+		state = newState()
+		deployer = internal.NewDeployer(&tested, NewMockAwsClient(state), logger)
+		err = deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}})
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "status:403"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+	})
+
+	t.Run("EC2Deploy#ResumeAndAbort", func(t *testing.T) {
+		newState := func() *TestingState {
+			return NewTestingState(config).
+				WithBucket(config).
+				WithLoadBalancer(
+					BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+					GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				).
+				WithAutoScalingGroups(
+					BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+					GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+				)
+		}
+		// the first traffic update fails, which stops the deploy before the swap, and leaves the checkpoint
+		steps := internal.TrafficSteps{{Weight: 50, BakeTime: 1}, {Weight: 100}}
+
+		state := newState().WithFailure("ModifyRule", 0)
+		err := internal.NewDeployer(config, NewMockAwsClient(state), logger).Deploy(ctx, true, true, true, steps)
+		assert.Failure(t, err)
+		assert.False(t, errors.Is(err, internal.CancellationError))
+		state.Failures = nil
+
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+		checkpoint, err := deployer.GetCheckpoint(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, checkpoint.Phase, internal.PhaseHealthCheck)
+		assert.Equal(t, *checkpoint.Info.IdlingTarget.AutoScalingGroup.DesiredCapacity, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(1))
+
+		// a new deploy is refused while the checkpoint exists
+		assert.Failure(t, deployer.Deploy(ctx, true, true, true, steps))
+
+		// the lock of another deployment is not taken over by the resume
+		state.WithLock(&internal.Lock{ID: "others", Owner: "others", Host: checkpoint.Host, ExpiresAt: time.Now().Add(time.Hour)})
+		err = deployer.ResumeDeploy(ctx)
+		assert.True(t, errors.Is(err, internal.LockedError))
+		assert.True(t, strings.Contains(err.Error(), "'lock release --force'"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+
+		// the lock left by the killed process of the deploy is taken over
+		assert.Success(t, internal.NewLocker(config, NewMockAwsClient(state), logger).Unlock(ctx, true))
+		state.WithLock(&internal.Lock{ID: "killed", Owner: checkpoint.Actor, Host: checkpoint.Host,
+			AcquiredAt: checkpoint.StartedAt.Add(-time.Second), ExpiresAt: time.Now().Add(time.Hour)})
+		assert.Success(t, deployer.ResumeDeploy(ctx))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.LockKey))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Green.AutoScalingGroupName).MinSize, int32(0))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.CheckpointKey))
+		assert.Failure(t, deployer.ResumeDeploy(ctx))
+
+		// abort restores the capacities and weights at the start of the deploy
+		state = newState().WithFailure("ModifyRule", 0)
+		err = internal.NewDeployer(config, NewMockAwsClient(state), logger).Deploy(ctx, true, true, true, steps)
+		assert.Failure(t, err)
+		state.Failures = nil
+
+		deployer = internal.NewDeployer(config, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.AbortDeploy(ctx))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).MinSize, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Green.AutoScalingGroupName).DesiredCapacity, int32(1))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.CheckpointKey))
+		assert.Success(t, deployer.AbortDeploy(ctx))
+	})
+
+	t.Run("EC2Deploy#Interrupted", func(t *testing.T) {
+		newState := func() *TestingState {
+			return NewTestingState(config).
+				WithBucket(config).
+				WithLoadBalancer(
+					BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+					GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				).
+				WithAutoScalingGroups(
+					BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+					GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+				)
+		}
+		// the signal arrives during the bake time of the first step
+		deploy := func(config *internal.Config, state *TestingState) error {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			time.AfterFunc(200*time.Millisecond, cancel)
+			deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+			return deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 50, BakeTime: 5 * time.Second}, {Weight: 100}})
+		}
+
+		// the traffic is restored and the checkpoint remains for resume
+		state := newState()
+		err := deploy(config, state)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(1))
+		assert.NotNil(t, state.FindBucketObject(config.BundleBucket, internal.CheckpointKey))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.LockKey))
+
+		// the idle target is also scaled down
+		scaleDown := *config
+		scaleDown.Cancellation = &internal.Cancellation{ScaleDownIdle: true, TimeoutSeconds: 10}
+		state = newState()
+		err = deploy(&scaleDown, state)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.CheckpointKey))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.LockKey))
+	})
+
+	t.Run("EC2Deploy#RetryPolicy", func(t *testing.T) {
+		newState := func(blueStates BlueHealthStates) *TestingState {
+			return NewTestingState(config).
+				WithBucket(config).
+				WithLoadBalancer(
+					BlueWeight(0), blueStates,
+					GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				).
+				WithAutoScalingGroups(
+					BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+					GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+				)
+		}
+		retried := *config
+		retried.RetryPolicy = &internal.RetryPolicy{
+			MaxLimit:        120,
+			IntervalSeconds: 10,
+			HealthCheck:     &internal.RetryStrategy{Type: internal.RetryTypeDeadline, IntervalSeconds: 1, TimeoutSeconds: 1},
+			Throttling:      &internal.RetryStrategy{Type: internal.RetryTypeJitter, MaxLimit: 3, IntervalSeconds: 1, MaxIntervalSeconds: 1},
+		}
+		steps := internal.TrafficSteps{{Weight: 100}}
+
+		// the throttling is retried by the AWS client, so the error that reaches the deployer is not retried again.
+		// the first one is only warned by the status for the history.
+		state := newState(BlueHealthStates{albTypes.TargetHealthStateEnumHealthy}).WithThrottling("DescribeTargetHealth", 2)
+		err := internal.NewDeployer(&retried, NewMockAwsClient(state), logger).Deploy(ctx, true, true, true, steps)
+		assert.Failure(t, err)
+		assert.True(t, strings.Contains(err.Error(), "Rate exceeded"))
+
+		// the deadline strategy gives up the health check after the timeout, and the deploy is rolled back
+		state = newState(BlueHealthStates{albTypes.TargetHealthStateEnumInitial})
+		err = internal.NewDeployer(&retried, NewMockAwsClient(state), logger).Deploy(ctx, true, true, true, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+	})
+
+	t.Run("EC2SwapTraffic#Steps", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(1), BlueMinSize(1), BlueMaxSize(2), BlueInstanceStates{asgTypes.LifecycleStateInService},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+
+		steps, err := internal.NewTrafficSteps("10,25:1ns,50,100", time.Duration(1))
+		assert.Success(t, err)
+		assert.Equal(t, len(steps), 4)
+		assert.Equal(t, steps[1].BakeTime, time.Duration(1))
+
+		assert.Success(t, deployer.SwapTraffic(ctx, steps))
+
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(0))
+	})
+
+	t.Run("EC2SwapTraffic#StepsIfUnhealthy", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumUnhealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(1), BlueMinSize(1), BlueMaxSize(2), BlueInstanceStates{asgTypes.LifecycleStateInService},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+
+		steps, err := internal.NewTrafficSteps("10,50,100", time.Duration(1))
+		assert.Success(t, err)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+	})
+
+	t.Run("EC2SwapTraffic#StepsIfApiError", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(1), BlueMinSize(1), BlueMaxSize(2), BlueInstanceStates{asgTypes.LifecycleStateInService},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			).
+			WithFailure("DescribeTargetHealth", 1)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+
+		// the health API fails during the bake time of the first step, after the traffic is split
+		steps, err := internal.NewTrafficSteps("10,50,100", time.Duration(1))
+		assert.Success(t, err)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "ServiceUnavailable"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+	})
+
+	t.Run("EC2SwapTraffic#StepsIfAlarm", func(t *testing.T) {
+		newState := func() *TestingState {
+			return NewTestingState(config).
+				WithBucket(config).
+				WithLoadBalancer(
+					BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+					GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				).
+				WithAutoScalingGroups(
+					BlueDesiredCapacity(1), BlueMinSize(1), BlueMaxSize(2), BlueInstanceStates{asgTypes.LifecycleStateInService},
+					GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+				).
+				WithAlarm("test-5xx-alarm", cwTypes.StateValueOk, cwTypes.StateValueOk, cwTypes.StateValueAlarm).
+				WithAlarm("test-latency-alarm", cwTypes.StateValueOk)
+		}
+		watched := *config
+		watched.HealthWatch = &internal.HealthWatch{
+			MinHealthyPercent: 100,
+			IntervalSeconds:   1,
+			AlarmNames:        []string{"test-5xx-alarm", "test-latency-alarm"},
+		}
+		steps, err := internal.NewTrafficSteps("10,50,100", time.Duration(1))
+		assert.Success(t, err)
+
+		// the alarm goes into ALARM during the bake time of the second step
+		state := newState()
+		deployer := internal.NewDeployer(&watched, NewMockAwsClient(state), logger)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "test-5xx-alarm"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+
+		// the alarms cannot be described during the bake time
+		state = newState().WithFailure("DescribeAlarms", 2)
+		deployer = internal.NewDeployer(&watched, NewMockAwsClient(state), logger)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "ServiceUnavailable"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+
+		// the alarms cannot be described before shifting, so it is cancelled without any change of the traffic
+		state = newState().WithFailure("DescribeAlarms", 0)
+		deployer = internal.NewDeployer(&watched, NewMockAwsClient(state), logger)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "Failed to describe the CloudWatch alarms."))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+
+		// an unknown alarm is cancelled as well, and the deploy cleans up the idle target without leaving the checkpoint
+		watched.HealthWatch.AlarmNames = []string{"test-unknown-alarm"}
+		state = newState()
+		deployer = internal.NewDeployer(&watched, NewMockAwsClient(state), logger)
+		err = deployer.Deploy(ctx, true, true, true, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "CloudWatch alarm not found."))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.CheckpointKey))
+	})
+
+	t.Run("EC2SwapTraffic#CanaryAnalysis", func(t *testing.T) {
+		newState := func(new5xx float64, newResponseTimes ...float64) *TestingState {
+			return NewTestingState(config).
+				WithBucket(config).
+				WithLoadBalancer(
+					BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+					GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				).
+				WithAutoScalingGroups(
+					BlueDesiredCapacity(1), BlueMinSize(1), BlueMaxSize(2), BlueInstanceStates{asgTypes.LifecycleStateInService},
+					GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+				).
+				WithMetric(config.Target.Blue.TargetGroupArn, "RequestCount", 600, 400).
+				WithMetric(config.Target.Blue.TargetGroupArn, "HTTPCode_Target_5XX_Count", new5xx).
+				WithMetric(config.Target.Blue.TargetGroupArn, "TargetResponseTime", newResponseTimes...).
+				WithMetric(config.Target.Green.TargetGroupArn, "RequestCount", 9000).
+				WithMetric(config.Target.Green.TargetGroupArn, "HTTPCode_Target_5XX_Count", 9).
+				WithMetric(config.Target.Green.TargetGroupArn, "TargetResponseTime", 0.1)
+		}
+		analyzed := *config
+		analyzed.CanaryAnalysis = &internal.CanaryAnalysis{
+			Enabled:              true,
+			MinRequestCount:      100,
+			Max5XXRateDiff:       1.0,
+			MaxResponseTimeRatio: 1.5,
+		}
+		steps, err := internal.NewTrafficSteps("10,100", time.Duration(1))
+		assert.Success(t, err)
+
+		// 5xx rate: 0.5% vs 0.1%, response time: 1.2x
+		state := newState(5, 0.12)
+		deployer := internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.SwapTraffic(ctx, steps))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+
+		// 5xx rate: 0.9% vs 0.1%, counted with the requests of all pages
+		state = newState(9, 0.1)
+		deployer = internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.SwapTraffic(ctx, steps))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+
+		// 5xx rate: 3% vs 0.1%
+		state = newState(30, 0.1)
+		deployer = internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "5xx rate"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+
+		// response time: 2x
+		state = newState(0, 0.2)
+		deployer = internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "response time"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+
+		// response time per period weighted by the requests: 0.132s (1.32x), while the simple average is 0.16s (1.6x)
+		state = newState(0, 0.02, 0.3)
+		deployer = internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.SwapTraffic(ctx, steps))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+
+		// the metrics are analyzed after the delay of CloudWatch
+		analyzed.CanaryAnalysis.MetricDelaySeconds = 1
+		state = newState(5, 0.12)
+		deployer = internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		startTime := time.Now()
+		assert.Success(t, deployer.SwapTraffic(ctx, steps))
+		assert.True(t, time.Since(startTime) >= time.Second)
+		analyzed.CanaryAnalysis.MetricDelaySeconds = 0
+
+		// too few requests to judge, so continue
+		analyzed.CanaryAnalysis.MinRequestCount = 10000
+		state = newState(30, 0.2)
+		deployer = internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.SwapTraffic(ctx, steps))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+
+		// or fail if configured
+		analyzed.CanaryAnalysis.FailIfInconclusive = true
+		state = newState(0, 0.1)
+		deployer = internal.NewDeployer(&analyzed, NewMockAwsClient(state), logger)
+		err = deployer.SwapTraffic(ctx, steps)
+		assert.True(t, errors.Is(err, internal.CancellationError))
+		assert.True(t, strings.Contains(err.Error(), "inconclusive"))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+	})
+
+	t.Run("Lock#IfLockedByOthers", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLock(&internal.Lock{ID: "others", Owner: "others", ExpiresAt: time.Now().Add(time.Hour)}).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+		bundler := internal.NewBundler(config, NewMockAwsClient(state), logger)
+		locker := internal.NewLocker(config, NewMockAwsClient(state), logger)
+
+		assert.True(t, errors.Is(deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}}), internal.LockedError))
+		assert.True(t, errors.Is(deployer.UpdateTraffic(ctx, 100, 0), internal.LockedError))
+		assert.True(t, errors.Is(bundler.Activate(ctx, internal.BlueTargetType, "bundle.zip"), internal.LockedError))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+
+		assert.True(t, errors.Is(locker.Unlock(ctx, false), internal.LockedError))
+		assert.Success(t, locker.ShowStatus(ctx, "table"))
+		assert.Success(t, locker.Unlock(ctx, true))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.LockKey))
+
+		assert.Success(t, deployer.UpdateTraffic(ctx, 100, 0))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.LockKey))
+	})
+
+	t.Run("Lock#IfExpired", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLock(&internal.Lock{ID: "others", Owner: "others", ExpiresAt: time.Now().Add(-time.Minute)}).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+
+		assert.Success(t, deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}}))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(100))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.LockKey))
+	})
+
+	t.Run("EC2History", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+		history := internal.NewHistory(config, NewMockAwsClient(state), logger)
+
+		assert.Success(t, deployer.Deploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 100}}))
+		assert.Failure(t, deployer.UpdateAutoScalingGroupByTarget(ctx, internal.TargetType("red"), nil, nil, nil))
+
+		records, err := history.List(ctx, 0)
+		assert.Success(t, err)
+		assert.Equal(t, len(records), 2)
+		for _, record := range records {
+			switch record.Operation {
+			case "deploy":
+				assert.Equal(t, record.Result, internal.HistoryResultSucceeded)
+				assert.Equal(t, record.Before[0].TrafficWeight, int32(0))
+				assert.Equal(t, record.After[0].TrafficWeight, int32(100))
+			case "autoscaling":
+				assert.Equal(t, record.Result, internal.HistoryResultFailed)
+			default:
+				t.Errorf("unexpected operation: %s", record.Operation)
+			}
+		}
+
+		records, err = history.List(ctx, 1)
+		assert.Success(t, err)
+		assert.Equal(t, len(records), 1)
+		assert.Success(t, history.ShowHistory(ctx, "table", 20))
+	})
+
+	t.Run("EC2DryRun", func(t *testing.T) {
+		state := NewTestingState(config).
+			WithBucket(config).
+			WithLoadBalancer(
+				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
+				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
+			).
+			WithAutoScalingGroups(
+				BlueDesiredCapacity(0), BlueMinSize(0), BlueMaxSize(2), BlueInstanceStates{},
+				GreenDesiredCapacity(1), GreenMinSize(1), GreenMaxSize(2), GreenInstanceStates{asgTypes.LifecycleStateInService},
+			)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+
+		plan, err := deployer.PlanDeploy(ctx, true, true, true, internal.TrafficSteps{{Weight: 50, BakeTime: 1}, {Weight: 100}})
+		assert.Success(t, err)
+		assert.Equal(t, len(plan.Actions), 8)
+		assert.Equal(t, plan.Actions[2].Change, "desired:0->1, min:0->1, max:2")
+		assert.Equal(t, plan.Actions[4].Change, "blue:0->50, green:100->50")
+		assert.Equal(t, plan.Actions[6].Change, "blue:50->100, green:50->0")
+		assert.Equal(t, plan.Actions[7].Target, config.Target.Green.AutoScalingGroupName)
+		assert.Equal(t, plan.Actions[7].Change, "desired:1, min:1->0, max:2")
+
+		plan, err = deployer.PlanUpdateAutoScalingGroupByTarget(ctx, internal.BlueTargetType, aws.Int32(3), nil, aws.Int32(-1))
+		assert.Success(t, err)
+		assert.Equal(t, len(plan.Actions), 1)
+		assert.Equal(t, plan.Actions[0].Change, "desired:0->3, min:0, max:2")
+
+		// nothing has been changed
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Blue.TargetGroupArn).Weight, int32(0))
+		assert.Equal(t, *state.LoadBalancer.FindTargetGroup(config.Target.Green.TargetGroupArn).Weight, int32(100))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).DesiredCapacity, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Blue.AutoScalingGroupName).MinSize, int32(0))
+		assert.Equal(t, *state.FindAutoScalingGroup(config.Target.Green.AutoScalingGroupName).MinSize, int32(1))
+		assert.Nil(t, state.FindBucketObject(config.BundleBucket, internal.LockKey))
+	})
+
+	t.Run("AwsClient#ClassifyError", func(t *testing.T) {
+		throttled := errors.WithStack(&smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"})
+		assert.Equal(t, internal.ClassifyError(throttled), internal.ErrorClassThrottled)
+		limited := errors.WithStack(&smithy.GenericAPIError{Code: "RequestLimitExceeded"})
+		assert.Equal(t, internal.ClassifyError(limited), internal.ErrorClassThrottled)
+		timeout := errors.WithStack(&smithy.GenericAPIError{Code: "RequestTimeout"})
+		assert.Equal(t, internal.ClassifyError(timeout), internal.ErrorClassRetryable)
+		denied := errors.WithStack(&smithy.GenericAPIError{Code: "AccessDenied"})
+		assert.Equal(t, internal.ClassifyError(denied), internal.ErrorClassFatal)
+		assert.Equal(t, internal.ClassifyError(errors.WithStack(context.Canceled)), internal.ErrorClassFatal)
+	})
+
+	t.Run("AwsClient#CustomEndpoint", func(t *testing.T) {
+		throttles := 2
+		var s3Paths []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				s3Paths = append(s3Paths, r.URL.Path)
+				w.Header().Set("Content-Type", "application/xml")
+				_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>test-deploy-bundle</Name><Prefix>bundles/</Prefix><KeyCount>1</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated><Contents><Key>bundles/bundle.zip</Key><LastModified>2026-01-01T00:00:00.000Z</LastModified><Size>1</Size></Contents></ListBucketResult>`))
+				return
+			}
+			_ = r.ParseForm()
+			w.Header().Set("Content-Type", "text/xml")
+			if r.Form.Get("Action") != "DescribeTargetHealth" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>InvalidAction</Code><Message>Unexpected action</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+				return
+			}
+			if throttles > 0 {
+				throttles--
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>Throttling</Code><Message>Rate exceeded</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+				return
+			}
+			_, _ = w.Write([]byte(`<DescribeTargetHealthResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2015-12-01/"><DescribeTargetHealthResult><TargetHealthDescriptions><member><Target><Id>10.0.0.1</Id><Port>80</Port></Target><TargetHealth><State>healthy</State></TargetHealth></member></TargetHealthDescriptions></DescribeTargetHealthResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></DescribeTargetHealthResponse>`))
+		}))
+		defer server.Close()
+
+		t.Setenv("AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+		t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+		t.Setenv("DEPLOYMAN_ENDPOINT_URL", server.URL)
+		t.Setenv("DEPLOYMAN_S3_USE_PATH_STYLE", "true")
+		retried := *config
+		retried.RetryPolicy = &internal.RetryPolicy{
+			Throttling: &internal.RetryStrategy{Type: internal.RetryTypeJitter, MaxLimit: 3, IntervalSeconds: 1, MaxIntervalSeconds: 1},
+		}
+		client, err := internal.NewDefaultAwsClient(ctx, &retried, nil)
+		assert.Success(t, err)
+
+		// S3 is addressed by path, not by the bucket subdomain
+		objects, next, err := client.ListS3BucketObjects(ctx, config.BundleBucket, internal.BundlePrefix, nil)
+		assert.Success(t, err)
+		assert.Nil(t, next)
+		assert.Equal(t, len(objects), 1)
+		assert.Equal(t, *objects[0].Key, "bundles/bundle.zip")
+		assert.Equal(t, s3Paths[0], "/"+config.BundleBucket)
+
+		// the throttled calls are retried by the middleware, and every attempt is counted
+		health, err := client.DescribeALBTargetHealth(ctx, config.Target.Blue.TargetGroupArn)
+		assert.Success(t, err)
+		assert.Equal(t, *health[0].Target.Id, "10.0.0.1")
+		stat := internal.FirstOrNil(client.CallStats().List(), func(s *internal.CallStat) bool {
+			return strings.HasSuffix(s.API, ".DescribeTargetHealth")
+		})
+		assert.NotNil(t, stat)
+		assert.Equal(t, stat.Calls, 1)
+		assert.Equal(t, stat.Attempts, 3)
+		assert.Equal(t, stat.Throttled, 2)
+
+		// the clients sharing the stats are counted together
+		shared, err := internal.NewDefaultAwsClient(ctx, nil, client.CallStats())
+		assert.Success(t, err)
+		_, _, err = shared.ListS3BucketObjects(ctx, config.BundleBucket, internal.BundlePrefix, nil)
+		assert.Success(t, err)
+		stat = internal.FirstOrNil(client.CallStats().List(), func(s *internal.CallStat) bool {
+			return strings.HasSuffix(s.API, ".ListObjectsV2")
+		})
+		assert.NotNil(t, stat)
+		assert.Equal(t, stat.Calls, 2)
+	})
+
+	t.Run("AwsClient#AssumeRole", func(t *testing.T) {
+		var assumed []string
+		var accessKeys []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = r.ParseForm()
+			w.Header().Set("Content-Type", "text/xml")
+			if r.Form.Get("Action") == "AssumeRole" {
+				assumed = append(assumed, fmt.Sprintf("%s,%s,%s", r.Form.Get("RoleArn"), r.Form.Get("ExternalId"), r.Form.Get("RoleSessionName")))
+				_, _ = w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials><AccessKeyId>ASSUMED</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration></Credentials><AssumedRoleUser><Arn>arn:aws:sts::123456789012:assumed-role/deploy/deployman</Arn><AssumedRoleId>AROA:deployman</AssumedRoleId></AssumedRoleUser></AssumeRoleResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></AssumeRoleResponse>`))
+				return
+			}
+			accessKeys = append(accessKeys, strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="), "/")[0])
+			_, _ = w.Write([]byte(`<DescribeTargetHealthResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2015-12-01/"><DescribeTargetHealthResult><TargetHealthDescriptions></TargetHealthDescriptions></DescribeTargetHealthResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></DescribeTargetHealthResponse>`))
+		}))
+		defer server.Close()
+
+		t.Setenv("AWS_ACCESS_KEY_ID", "ambient")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "ambient")
+		t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+		t.Setenv("AWS_REGION", "us-east-1")
+		assumer := *config
+		assumer.EndpointUrl = server.URL
+		assumer.Region = "ap-northeast-1"
+		assumer.RoleArn = "arn:aws:iam::123456789012:role/deploy"
+		assumer.ExternalId = "external"
+		client, err := internal.NewDefaultAwsClient(ctx, &assumer, nil)
+		assert.Success(t, err)
+		assert.Equal(t, client.Region(), "ap-northeast-1")
+
+		// the role is assumed once, and the cached credentials sign every call
+		for i := 0; i < 2; i++ {
+			_, err := client.DescribeALBTargetHealth(ctx, config.Target.Blue.TargetGroupArn)
+			assert.Success(t, err)
+		}
+		assert.Equal(t, len(assumed), 1)
+		assert.Equal(t, assumed[0], "arn:aws:iam::123456789012:role/deploy,external,deployman")
+		assert.Equal(t, len(accessKeys), 2)
+		assert.Equal(t, accessKeys[0], "ASSUMED")
+		assert.Equal(t, accessKeys[1], "ASSUMED")
+	})
+
+	t.Run("TrafficSteps#Invalid", func(t *testing.T) {
+		for _, spec := range []string{"10,50", "50,10,100", "0,100", "10,101", "a,100", "10:x,100"} {
+			_, err := internal.NewTrafficSteps(spec, time.Duration(1))
+			assert.Failure(t, err)
+		}
+	})
+
 	t.Run("EC2AutoScalingGroupByTarget", func(t *testing.T) {
 		state := NewTestingState(config).
+			WithBucket(config).
 			WithLoadBalancer(
 				BlueWeight(0), BlueHealthStates{albTypes.TargetHealthStateEnumHealthy},
 				GreenWeight(100), GreenHealthStates{albTypes.TargetHealthStateEnumHealthy},
@@ -182,4 +1483,24 @@ func TestE2E(t *testing.T) {
 		assert.Equal(t, len(state.FindAutoScalingGroup("fromASG").ScheduledActions), 0)
 		assert.Equal(t, len(state.FindAutoScalingGroup("toASG").ScheduledActions), len(scheduledActions))
 	})
+	t.Run("EC2MoveScheduledAction#Pages", func(t *testing.T) {
+		var scheduledActions []asgTypes.ScheduledUpdateGroupAction
+		for i := 0; i < MockPageSize*2+5; i++ {
+			scheduledActions = append(scheduledActions, asgTypes.ScheduledUpdateGroupAction{
+				AutoScalingGroupName: aws.String("fromASG"),
+				DesiredCapacity:      aws.Int32(1),
+				Recurrence:           aws.String("1/* * * * *"),
+				ScheduledActionName:  aws.String(fmt.Sprintf("fromAction%03d", i)),
+			})
+		}
+		state := NewTestingState(config).WithAutoScalingGroupScheduledAction(
+			"fromASG", scheduledActions,
+			"toASG", []asgTypes.ScheduledUpdateGroupAction{},
+		)
+		deployer := internal.NewDeployer(config, NewMockAwsClient(state), logger)
+		assert.Success(t, deployer.MoveScheduledActions(ctx, "fromASG", "toASG"))
+		assert.Equal(t, len(state.FindAutoScalingGroup("fromASG").ScheduledActions), 0)
+		assert.Equal(t, len(state.FindAutoScalingGroup("toASG").ScheduledActions), MockPageSize*2+5)
+	})
+
 }